@@ -0,0 +1,110 @@
+package hookdb
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// WriteBatch collects puts and deletes to be applied atomically by Write.
+// The keys and values must not be modified until the batch is written.
+type WriteBatch struct {
+	entries []walEntry
+}
+
+func (b *WriteBatch) Put(k, v []byte) {
+	b.entries = append(b.entries, walEntry{op: walPut, k: k, v: v})
+}
+
+// Delete deletes k. It is a no-op if k does not exist when the batch is written.
+func (b *WriteBatch) Delete(k []byte) {
+	b.entries = append(b.entries, walEntry{op: walDelete, k: k})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Reset empties the batch for reuse.
+func (b *WriteBatch) Reset() {
+	clear(b.entries)
+	b.entries = b.entries[:0]
+}
+
+func (s *l3Store) Write(b *WriteBatch) error {
+	if err := s.lockWrite(context.Background()); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	return s.write(b)
+}
+
+// write applies b. The caller must hold the write lock.
+// Writes queued by hooks are checked here too, before anything is logged.
+func (s *l3Store) write(b *WriteBatch) error {
+	for _, e := range b.entries {
+		if len(e.k) == 0 {
+			return ErrEmptyEntry
+		}
+	}
+	// only the last operation of each key is applied
+	var (
+		now   = time.Now().UnixNano()
+		last  = make(map[string]int, len(b.entries))
+		prevs = make(map[string][]byte, len(b.entries))
+	)
+	for n, e := range b.entries {
+		k := string(e.k)
+		if _, found := last[k]; !found {
+			if o, err := s.l2values.Exec(s.l2values.get, input[[]byte]{k: e.k}); err == nil && o.alive(now) {
+				prevs[k] = o.val
+			}
+		}
+		last[k] = n
+	}
+	var (
+		entries = make([]walEntry, 0, len(last))
+		puts    = make([]input[[]byte], 0, len(last))
+		dels    = make([]input[[]byte], 0, len(last))
+		events  = make([]Event, 0, len(last))
+	)
+	for n, e := range b.entries {
+		if last[string(e.k)] != n {
+			continue
+		}
+		prev, found := prevs[string(e.k)]
+		switch e.op {
+		case walPut:
+			if err := validate(s.l2hooks, e.k, e.v); err != nil {
+				return err
+			}
+			puts = append(puts, input[[]byte]{k: e.k, v: e.v})
+			events = append(events, Event{Op: OpPut, Key: e.k, Value: e.v, Prev: prev})
+		case walDelete:
+			if !found {
+				continue
+			}
+			dels = append(dels, input[[]byte]{k: e.k})
+			events = append(events, Event{Op: OpDelete, Key: e.k, Prev: prev})
+		}
+		entries = append(entries, e)
+	}
+	// all operations are logged as a single record
+	if err := s.log(entries...); err != nil {
+		return err
+	}
+	// the keys of puts and deletes are distinct, so they can be applied in any order
+	_, putErrs := s.l2values.BatchExec(s.l2values.put, puts...)
+	_, delErrs := s.l2values.BatchExec(s.l2values.delete, dels...)
+	if err := errors.Join(append(putErrs, delErrs...)...); err != nil {
+		return err
+	}
+	// every event is recorded even if hooks fail, so that it has its sequence number
+	errs := make([]error, 0, len(events))
+	for _, e := range events {
+		errs = append(errs, s.callback(e))
+	}
+	s.compact()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,107 @@
+package hookdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch(t *testing.T) {
+	t.Run("events", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		assert.NoError(t, db.Put([]byte("key-2"), []byte("val-2")))
+		var events []string
+		_, err := db.AppendEventHook([]byte("key"), func(e Event) bool {
+			events = append(events, fmt.Sprintf("%d %s %s %s %s", e.Seq, e.Op, e.Key, e.Value, e.Prev))
+			return false
+		})
+		assert.NoError(t, err)
+
+		var b WriteBatch
+		b.Put([]byte("key-3"), []byte("val-3"))
+		b.Put([]byte("key-1"), []byte("newval-1"))
+		b.Delete([]byte("key-2"))
+		b.Put([]byte("key-3"), []byte("newval-3"))
+		b.Put([]byte("key-4"), []byte("val-4"))
+		b.Delete([]byte("key-4"))
+		b.Delete([]byte("key-5"))
+		assert.Equal(t, 7, b.Len())
+		assert.NoError(t, db.Write(&b))
+
+		assert.Equal(t, []string{
+			"3 put key-1 newval-1 val-1",
+			"4 delete key-2  val-2",
+			"5 put key-3 newval-3 ",
+		}, events)
+		var got []string
+		for kv, err := range db.QueryKV(context.Background(), []byte("key")) {
+			assert.NoError(t, err)
+			got = append(got, string(kv.Key)+"="+string(kv.Value))
+		}
+		assert.Equal(t, []string{"key-1=newval-1", "key-3=newval-3"}, got)
+
+		b.Reset()
+		assert.Zero(t, b.Len())
+		assert.NoError(t, db.Write(&b))
+	})
+
+	t.Run("empty key", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var b WriteBatch
+		b.Put([]byte("key-1"), []byte("val-1"))
+		b.Put(nil, []byte("val"))
+		assert.ErrorIs(t, db.Write(&b), ErrEmptyEntry)
+		_, err := db.Get([]byte("key-1"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("persistent", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir)
+		require.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("key-0"), []byte("val-0")))
+		var b WriteBatch
+		for i := range 1000 {
+			b.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("val-%d", i)))
+		}
+		b.Delete([]byte("key-0"))
+		assert.NoError(t, db.Write(&b))
+		require.NoError(t, db.Close())
+
+		db, err = Open(dir)
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.Get([]byte("key-0"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		v, err := db.Get([]byte("key-999"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-999", string(v))
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		txn := db.Transaction()
+		var b WriteBatch
+		b.Put([]byte("key-2"), []byte("val-2"))
+		b.Delete([]byte("key-1"))
+		assert.NoError(t, txn.Write(&b))
+		_, err := db.Get([]byte("key-2"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		assert.NoError(t, txn.Commit())
+
+		_, err = db.Get([]byte("key-1"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		v, err := db.Get([]byte("key-2"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-2", string(v))
+	})
+}
@@ -0,0 +1,50 @@
+package hookdb
+
+import "fmt"
+
+// changeLog keeps the latest events in a ring buffer.
+type changeLog struct {
+	buf []Event
+	// index of the oldest event
+	head int
+	n    int
+}
+
+func newChangeLog(size int) *changeLog {
+	return &changeLog{buf: make([]Event, size)}
+}
+
+func (l *changeLog) append(e Event) {
+	if len(l.buf) == 0 {
+		return
+	}
+	if l.n < len(l.buf) {
+		l.buf[(l.head+l.n)%len(l.buf)] = e
+		l.n++
+		return
+	}
+	l.buf[l.head] = e
+	l.head = (l.head + 1) % len(l.buf)
+}
+
+// since returns the events with Seq at or after seq, oldest first, where last is the Seq
+// of the latest event. It returns ErrSeqNotRetained if some of them have already been evicted,
+// and ErrFutureSeq if seq is after the Seq of the next event.
+func (l *changeLog) since(seq, last uint64) ([]Event, error) {
+	switch {
+	case last+1 < seq:
+		return nil, fmt.Errorf("%w: %d, the last is %d", ErrFutureSeq, seq, last)
+	case last < seq:
+		return nil, nil
+	case l.n == 0 || seq < l.buf[l.head].Seq:
+		return nil, ErrSeqNotRetained
+	}
+	events := make([]Event, 0, last-seq+1)
+	for i := range l.n {
+		e := l.buf[(l.head+i)%len(l.buf)]
+		if seq <= e.Seq {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
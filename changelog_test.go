@@ -0,0 +1,49 @@
+package hookdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeLog(t *testing.T) {
+	seqs := func(events []Event) []uint64 {
+		var s []uint64
+		for _, e := range events {
+			s = append(s, e.Seq)
+		}
+		return s
+	}
+
+	l := newChangeLog(3)
+	events, err := l.since(1, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	for seq := range uint64(5) {
+		l.append(Event{Seq: seq + 1})
+	}
+	events, err = l.since(3, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3, 4, 5}, seqs(events))
+	events, err = l.since(5, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{5}, seqs(events))
+	events, err = l.since(6, 5)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	// evicted
+	_, err = l.since(2, 5)
+	assert.ErrorIs(t, err, ErrSeqNotRetained)
+	// future
+	_, err = l.since(7, 5)
+	assert.ErrorIs(t, err, ErrFutureSeq)
+
+	// disabled
+	l = newChangeLog(0)
+	l.append(Event{Seq: 1})
+	_, err = l.since(1, 1)
+	assert.ErrorIs(t, err, ErrSeqNotRetained)
+	_, err = l.since(2, 1)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,219 @@
+package hookdb
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// dispatcher runs async hooks on a pool of workers. Events of a key are always
+	// queued to the same worker, so that they are delivered in order.
+	//
+	// Events are queued while the database is locked without blocking, and writers wait
+	// for room in the queue before taking the lock instead, so that async hooks
+	// can use the database. Writes with the context passed to async hooks never wait,
+	// since the queue cannot drain until the hooks return.
+	dispatcher struct {
+		size    int
+		workers []*hookWorker
+		start   sync.Once
+		stop    chan struct{}
+		wg      sync.WaitGroup
+		// ctx is passed to async hooks to mark their writes
+		ctx context.Context
+
+		onError func(err *HookError)
+
+		pending int
+		// changed is closed and replaced whenever pending decreases
+		changed chan struct{}
+		mu      sync.Mutex // mu for pending and changed
+	}
+	hookWorker struct {
+		queue  []delivery
+		notify chan struct{}
+		mu     sync.Mutex // mu for queue
+	}
+	delivery struct {
+		e Event
+		h *asyncHook
+	}
+	asyncHook struct {
+		prefix []byte
+		fn     AsyncHookHandler
+		// removed is set once fn asks to be removed
+		removed atomic.Bool
+	}
+)
+
+func newDispatcher(workers, size int, onError func(err *HookError)) *dispatcher {
+	d := &dispatcher{
+		size:    size,
+		onError: onError,
+		workers: make([]*hookWorker, max(workers, 1)),
+		stop:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	d.ctx = context.WithValue(context.Background(), dispatcherKey{}, d)
+	for n := range d.workers {
+		d.workers[n] = &hookWorker{notify: make(chan struct{}, 1)}
+	}
+	return d
+}
+
+// dispatcherKey is the key of the dispatcher in the context passed to async hooks.
+type dispatcherKey struct{}
+
+// enqueue queues the event for h without blocking.
+// Events are dropped once the dispatcher is closed, since no worker would deliver them.
+func (d *dispatcher) enqueue(e Event, h *asyncHook) {
+	d.mu.Lock()
+	select {
+	case <-d.stop:
+		d.mu.Unlock()
+		return
+	default:
+	}
+	d.start.Do(func() {
+		for _, w := range d.workers {
+			d.wg.Add(1)
+			go d.run(w)
+		}
+	})
+	d.pending++
+	d.mu.Unlock()
+
+	hash := fnv.New32a()
+	_, _ = hash.Write(e.Key)
+	w := d.workers[hash.Sum32()%uint32(len(d.workers))]
+	w.mu.Lock()
+	w.queue = append(w.queue, delivery{e: e, h: h})
+	w.mu.Unlock()
+	notify(w.notify)
+}
+
+func (d *dispatcher) run(w *hookWorker) {
+	defer d.wg.Done()
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			select {
+			case <-d.stop:
+				return
+			case <-w.notify:
+			}
+			continue
+		}
+		dl := w.queue[0]
+		w.queue[0] = delivery{}
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		if !dl.h.removed.Load() {
+			remove, herr := call(func(_ *HookContext, e Event) bool {
+				return dl.h.fn(d.ctx, e)
+			}, &HookContext{}, dl.e, dl.h.prefix)
+			if herr != nil {
+				d.onError(herr)
+			}
+			if remove {
+				dl.h.removed.Store(true)
+			}
+		}
+		d.mu.Lock()
+		d.pending--
+		close(d.changed)
+		d.changed = make(chan struct{})
+		d.mu.Unlock()
+	}
+}
+
+// wait waits until ok returns true for the number of pending events, or ctx is done.
+func (d *dispatcher) wait(ctx context.Context, ok func(pending int) bool) error {
+	for {
+		d.mu.Lock()
+		if ok(d.pending) {
+			d.mu.Unlock()
+			return nil
+		}
+		changed := d.changed
+		d.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// throttle waits until the queue has room for more events,
+// unless ctx is derived from the context passed to async hooks.
+func (d *dispatcher) throttle(ctx context.Context) error {
+	if d == nil || ctx.Value(dispatcherKey{}) == d {
+		return nil
+	}
+	return d.wait(ctx, func(pending int) bool { return pending < d.size })
+}
+
+// flush waits until all queued events are delivered.
+func (d *dispatcher) flush(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	return d.wait(ctx, func(pending int) bool { return pending == 0 })
+}
+
+// close delivers the queued events and stops the workers.
+func (d *dispatcher) close() {
+	if d == nil {
+		return
+	}
+	// async hooks may queue more events while they are delivered
+	for {
+		_ = d.flush(context.Background())
+		d.mu.Lock()
+		if d.pending == 0 {
+			select {
+			case <-d.stop:
+			default:
+				close(d.stop)
+			}
+			d.mu.Unlock()
+			break
+		}
+		d.mu.Unlock()
+	}
+	d.wg.Wait()
+}
+
+func (s *l3Store) AppendAsyncHook(prefix []byte, fn AsyncHookHandler) (HookID, error) {
+	h := &asyncHook{prefix: bytes.Clone(prefix), fn: fn}
+	d := s.dispatcher
+	return s.AppendContextHook(prefix, func(_ *HookContext, e Event) bool {
+		if h.removed.Load() {
+			return true
+		}
+		d.enqueue(e, h)
+		return false
+	})
+}
+
+func (s *l3Store) WaitHooks(ctx context.Context) error {
+	return s.dispatcher.flush(ctx)
+}
+
+// lockWrite takes the write lock after waiting for room in the queue of async hooks.
+// Writes of transactions queue no events until they are committed, so they do not wait.
+func (s *l3Store) lockWrite(ctx context.Context) error {
+	// only the origin store has a reaper
+	if s.reaper != nil {
+		if err := s.dispatcher.throttle(ctx); err != nil {
+			return err
+		}
+	}
+	return lockContext(ctx, s.mu.TryLock, s.mu.Lock, s.mu.Unlock)
+}
@@ -0,0 +1,224 @@
+package hookdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncHook(t *testing.T) {
+	t.Run("order per key", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithHookWorkers(3))
+		defer db.Close()
+		var mu sync.Mutex
+		got := map[string][]string{}
+		_, err := db.AppendAsyncHook([]byte("key"), func(ctx context.Context, e Event) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			got[string(e.Key)] = append(got[string(e.Key)], string(e.Value))
+			return false
+		})
+		require.NoError(t, err)
+
+		want := map[string][]string{}
+		for n := range 100 {
+			k, v := fmt.Sprintf("key-%d", n%5), fmt.Sprintf("val-%d", n)
+			assert.NoError(t, db.Put([]byte(k), []byte(v)))
+			want[k] = append(want[k], v)
+		}
+		assert.NoError(t, db.WaitHooks(context.Background()))
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("slow hook", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		defer db.Close()
+		release := make(chan struct{})
+		_, err := db.AppendAsyncHook([]byte("key"), func(ctx context.Context, e Event) bool {
+			<-release
+			return false
+		})
+		require.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, db.WaitHooks(ctx), context.DeadlineExceeded)
+		close(release)
+		assert.NoError(t, db.WaitHooks(context.Background()))
+	})
+
+	t.Run("queue size", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithHookWorkers(1), WithHookQueueSize(1))
+		defer db.Close()
+		release := make(chan struct{})
+		_, err := db.AppendAsyncHook([]byte("key"), func(ctx context.Context, e Event) bool {
+			<-release
+			return false
+		})
+		require.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.NoError(t, db.Put([]byte("key-2"), []byte("val-2")))
+		}()
+		select {
+		case <-done:
+			t.Fatal("put did not wait for the queue")
+		case <-time.After(10 * time.Millisecond):
+		}
+		close(release)
+		<-done
+	})
+
+	t.Run("use db", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		defer db.Close()
+		_, err := db.AppendAsyncHook([]byte("order#"), func(ctx context.Context, e Event) bool {
+			v, err := db.Get(e.Key)
+			assert.NoError(t, err)
+			assert.NoError(t, db.Put(append([]byte("copy#"), e.Key...), v))
+			return false
+		})
+		require.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("order#1"), []byte("apple")))
+		assert.NoError(t, db.WaitHooks(context.Background()))
+		v, err := db.Get([]byte("copy#order#1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "apple", string(v))
+	})
+
+	t.Run("use db with full queue", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithHookWorkers(1), WithHookQueueSize(1))
+		defer db.Close()
+		var copies sync.WaitGroup
+		_, err := db.AppendAsyncHook([]byte("order#"), func(ctx context.Context, e Event) bool {
+			// both writes are queued for the hook of copies on the same worker
+			assert.NoError(t, db.PutContext(ctx, append([]byte("copy#1#"), e.Key...), e.Value))
+			// writes from goroutines of the hook do not wait either
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, db.PutContext(ctx, append([]byte("copy#2#"), e.Key...), e.Value))
+			}()
+			wg.Wait()
+			return false
+		})
+		require.NoError(t, err)
+		_, err = db.AppendAsyncHook([]byte("copy#"), func(ctx context.Context, e Event) bool {
+			copies.Done()
+			return false
+		})
+		require.NoError(t, err)
+
+		copies.Add(20)
+		for n := range 10 {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("order#%d", n)), []byte("apple")))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, db.WaitHooks(ctx))
+		copies.Wait()
+		for n := range 10 {
+			for _, c := range []string{"copy#1#", "copy#2#"} {
+				_, err := db.Get([]byte(fmt.Sprintf("%sorder#%d", c, n)))
+				assert.NoError(t, err)
+			}
+		}
+	})
+
+	t.Run("transaction with full queue", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithHookWorkers(1), WithHookQueueSize(1))
+		defer db.Close()
+		_, err := db.AppendAsyncHook([]byte("order#"), func(ctx context.Context, e Event) bool {
+			assert.NoError(t, db.PutContext(ctx, append([]byte("copy#"), e.Key...), e.Value))
+			return false
+		})
+		require.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("order#1"), []byte("apple")))
+		// the hook waits for the lock of the transaction, whose writes queue no events
+		txn := db.TransactionWithLock()
+		assert.NoError(t, txn.Put([]byte("key-1"), []byte("val-1")))
+		assert.NoError(t, txn.Commit())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, db.WaitHooks(ctx))
+		v, err := db.Get([]byte("copy#order#1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "apple", string(v))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		defer db.Close()
+		var called int
+		_, err := db.AppendAsyncHook([]byte("key"), func(ctx context.Context, e Event) bool {
+			called++
+			return true
+		})
+		require.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		assert.NoError(t, db.WaitHooks(context.Background()))
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-2")))
+		assert.NoError(t, db.WaitHooks(context.Background()))
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var called int
+		_, err := db.AppendAsyncHook([]byte("key"), func(ctx context.Context, e Event) bool {
+			time.Sleep(time.Millisecond)
+			called++
+			return false
+		})
+		require.NoError(t, err)
+		for n := range 5 {
+			assert.NoError(t, db.Put([]byte("key-1"), []byte(fmt.Sprint(n))))
+		}
+		assert.NoError(t, db.Close())
+		assert.Equal(t, 5, called)
+	})
+
+	t.Run("write after close", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithHookQueueSize(2))
+		_, err := db.AppendAsyncHook([]byte("key"), func(ctx context.Context, e Event) bool {
+			return false
+		})
+		require.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		assert.NoError(t, db.Close())
+		// writes are rejected without queuing events no worker would deliver
+		for n := range 5 {
+			assert.ErrorIs(t, db.Put([]byte("key-1"), []byte(fmt.Sprint(n))), ErrClosed)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, db.WaitHooks(ctx))
+		// events of writes racing with Close are dropped
+		db.l3.(*l3Store).dispatcher.enqueue(Event{Key: []byte("key-1")}, &asyncHook{})
+		assert.NoError(t, db.WaitHooks(ctx))
+	})
+}
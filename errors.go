@@ -1,10 +1,52 @@
 package hookdb
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrKeyNotFound       = errors.New("key not found")
 	ErrEmptyEntry        = errors.New("entry(i,k) cannot be empty")
 	ErrDeleted           = errors.New("deleted")
 	ErrClosedTransaction = errors.New("transaction is closed")
+	ErrClosed            = errors.New("database is closed")
+	ErrSlowSubscriber    = errors.New("subscriber is too slow")
+	ErrSeqNotRetained    = errors.New("sequence number is no longer retained")
+	ErrFutureSeq         = errors.New("sequence number is after the next write")
+	ErrReleasedSnapshot  = errors.New("snapshot is released")
+	ErrConflict          = errors.New("transaction conflicts with a concurrent write")
+	ErrInvalidSavepoint  = errors.New("savepoint is released or rolled back")
+	ErrNoMergeOperator   = errors.New("no merge operator for the key")
+	ErrHookDepthExceeded = errors.New("writes from hooks exceed the max cascade depth")
+	ErrInvalidValue      = errors.New("value is rejected by a validator")
 )
+
+// HookError reports a panic of a hook handler. The panic is recovered,
+// and the write and the other hooks continue as if the handler returned false.
+//
+// It also reports an error of the hooks of a committed transaction, such as ErrHookDepthExceeded,
+// which does not fail the commit. Value is the error, and Prefix and Stack are nil.
+type HookError struct {
+	// Prefix is the prefix the hook is registered with.
+	Prefix []byte
+	// Key is the key of the event passed to the hook.
+	Key []byte
+	// Value is the value passed to panic.
+	Value any
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *HookError) Error() string {
+	if e.Stack == nil {
+		return fmt.Sprintf("hooks failed on key '%s': %v", e.Key, e.Value)
+	}
+	return fmt.Sprintf("hook of prefix '%s' panicked on key '%s': %v", e.Prefix, e.Key, e.Value)
+}
+
+// Unwrap returns Value if it is an error.
+func (e *HookError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
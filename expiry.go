@@ -0,0 +1,107 @@
+package hookdb
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// reaper runs a background goroutine removing expired keys.
+// It is started by the first write with a ttl.
+type reaper struct {
+	interval time.Duration
+
+	stop   chan struct{}
+	done   chan struct{}
+	closed bool
+	mu     sync.Mutex // mu for stop, done and closed
+}
+
+func (s *l3Store) startReaper() {
+	r := s.reaper
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil || r.closed {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	r.stop, r.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				_ = s.expire(now.UnixNano())
+			}
+		}
+	}()
+}
+
+// resumeReaper starts the reaper if any key restored from a log or a snapshot has a ttl.
+// It is called once the store is built, since the reaper writes to it.
+func (s *l3Store) resumeReaper() {
+	if len(s.l2values.l1Store.(*l1BaseStore[[]byte]).exps) != 0 {
+		s.startReaper()
+	}
+}
+
+func (r *reaper) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.closed = true
+	stop, done := r.stop, r.done
+	r.stop = nil
+	r.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// expire deletes the keys expired at now and calls hooks with OpExpire events
+// in order of expiry.
+func (s *l3Store) expire(now int64) error {
+	if err := s.lockWrite(context.Background()); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	outputs := s.l2values.l1Store.(*l1BaseStore[[]byte]).expired(now)
+	if len(outputs) == 0 {
+		return nil
+	}
+	slices.SortFunc(outputs, func(a, b output[[]byte]) int {
+		return cmp.Or(cmp.Compare(a.exp, b.exp), cmp.Compare(a.i, b.i))
+	})
+	entries := make([]walEntry, 0, len(outputs))
+	for _, o := range outputs {
+		entries = append(entries, walEntry{op: walDelete, k: o.key})
+	}
+	if err := s.log(entries...); err != nil {
+		return err
+	}
+	for _, o := range outputs {
+		_, err := s.l2values.Exec(s.l2values.delete, input[[]byte]{i: o.i})
+		if err != nil {
+			return err
+		}
+	}
+	// every event is recorded even if hooks fail, so that it has its sequence number
+	errs := make([]error, 0, len(outputs))
+	for _, o := range outputs {
+		errs = append(errs, s.callback(Event{Op: OpExpire, Key: o.key, Prev: o.val}))
+	}
+	s.compact()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,140 @@
+package hookdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutWithTTL(t *testing.T) {
+	t.Run("get and query", func(t *testing.T) {
+		t.Parallel()
+		// no background removal during the test
+		db := New(WithExpiryInterval(time.Hour))
+		defer db.Close()
+		assert.NoError(t, db.PutWithTTL([]byte("session1"), []byte("alice"), 20*time.Millisecond))
+		assert.NoError(t, db.PutWithTTL([]byte("session2"), []byte("bob"), time.Hour))
+		assert.NoError(t, db.Put([]byte("session3"), []byte("carol")))
+		assert.Error(t, db.PutWithTTL([]byte("session4"), []byte("dave"), 0))
+
+		v, err := db.Get([]byte("session1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", string(v))
+
+		time.Sleep(30 * time.Millisecond)
+		_, err = db.Get([]byte("session1"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		assert.ErrorIs(t, db.Delete([]byte("session1")), ErrKeyNotFound)
+		var got []string
+		for v, err := range db.Query(context.Background(), []byte("session")) {
+			assert.NoError(t, err)
+			got = append(got, string(v))
+		}
+		assert.Equal(t, []string{"bob", "carol"}, got)
+	})
+
+	t.Run("expire event", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithExpiryInterval(5 * time.Millisecond))
+		defer db.Close()
+		events := make(chan Event, 4)
+		_, err := db.AppendEventHook([]byte("session"), func(e Event) (removeHook bool) {
+			events <- e
+			return false
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.PutWithTTL([]byte("session1"), []byte("alice"), 10*time.Millisecond))
+		// put again without ttl clears the ttl
+		assert.NoError(t, db.PutWithTTL([]byte("session2"), []byte("bob"), 10*time.Millisecond))
+		assert.NoError(t, db.Put([]byte("session2"), []byte("bob")))
+
+		assert.Equal(t, OpPut, (<-events).Op)
+		assert.Equal(t, OpPut, (<-events).Op)
+		assert.Equal(t, OpPut, (<-events).Op)
+		e := <-events
+		assert.Equal(t, OpExpire, e.Op)
+		assert.Equal(t, "session1", string(e.Key))
+		assert.Equal(t, "alice", string(e.Prev))
+
+		time.Sleep(30 * time.Millisecond)
+		assert.Empty(t, events)
+		v, err := db.Get([]byte("session2"))
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", string(v))
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithExpiryInterval(5 * time.Millisecond))
+		defer db.Close()
+		txn := db.Transaction()
+		assert.NoError(t, txn.PutWithTTL([]byte("session1"), []byte("alice"), 20*time.Millisecond))
+		assert.NoError(t, txn.Commit())
+
+		v, err := db.Get([]byte("session1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", string(v))
+		time.Sleep(40 * time.Millisecond)
+		_, err = db.Get([]byte("session1"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		base := db.l3.(*l3Store).l2values.l1Store.(*l1BaseStore[[]byte])
+		db.l3.(*l3Store).mu.RLock()
+		assert.Empty(t, base.exps)
+		db.l3.(*l3Store).mu.RUnlock()
+	})
+
+	t.Run("persistence", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir, WithExpiryInterval(time.Hour))
+		require.NoError(t, err)
+		assert.NoError(t, db.PutWithTTL([]byte("session1"), []byte("alice"), 20*time.Millisecond))
+		assert.NoError(t, db.PutWithTTL([]byte("session2"), []byte("bob"), time.Hour))
+		require.NoError(t, db.Close())
+
+		time.Sleep(30 * time.Millisecond)
+		db, err = Open(dir, WithExpiryInterval(time.Hour))
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.Get([]byte("session1"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		v, err := db.Get([]byte("session2"))
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", string(v))
+	})
+
+	t.Run("reap after open", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir, WithExpiryInterval(time.Hour))
+		require.NoError(t, err)
+		for n := range 100 {
+			assert.NoError(t, db.PutWithTTL([]byte(fmt.Sprintf("session%d", n)), []byte("alice"), time.Millisecond))
+		}
+		require.NoError(t, db.Close())
+
+		// the reaper starts once the log is replayed
+		db, err = Open(dir, WithExpiryInterval(time.Nanosecond))
+		require.NoError(t, err)
+		base := db.l3.(*l3Store).l2values.l1Store.(*l1BaseStore[[]byte])
+		assert.Eventually(t, func() bool {
+			db.l3.(*l3Store).mu.RLock()
+			defer db.l3.(*l3Store).mu.RUnlock()
+			return len(base.exps) == 0
+		}, time.Second, time.Millisecond)
+		require.NoError(t, db.Close())
+
+		// the expiries are logged
+		db, err = Open(dir, WithExpiryInterval(time.Hour))
+		require.NoError(t, err)
+		defer db.Close()
+		base = db.l3.(*l3Store).l2values.l1Store.(*l1BaseStore[[]byte])
+		assert.Empty(t, base.exps)
+		assert.Equal(t, uint64(200), db.l3.(*l3Store).seq)
+	})
+}
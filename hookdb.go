@@ -2,22 +2,177 @@ package hookdb
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"iter"
+	"math/rand/v2"
+	"time"
 )
 
-// in handler, cannot appned hook
+// HookHandler is called with every put of keys with the registered prefix.
+// It is called while the database is locked, so it must not call methods of the database.
+// To write from a hook, use ContextHookHandler.
 type HookHandler func(k, v []byte) (removeHook bool)
 
+// EventHandler is called with every put, delete and expiry of keys with the registered prefix.
+// Like HookHandler, it must not call methods of the database.
+type EventHandler func(e Event) (removeHook bool)
+
+// ContextHookHandler is an EventHandler that can write to the database through hc.
+type ContextHookHandler func(hc *HookContext, e Event) (removeHook bool)
+
+// AsyncHookHandler is an EventHandler called after the write, which may use the database.
+// Writes by PutContext and DeleteContext with ctx, or a context derived from it, never wait
+// for room in the queue of async hooks, even from goroutines started by the handler.
+// Other writes wait like any write, and so wait forever if the queue is full of events of the handler.
+type AsyncHookHandler func(ctx context.Context, e Event) (removeHook bool)
+
+// Validator is called with every put of keys with the registered prefix before the value is written.
+// An error rejects the write. Like HookHandler, it must not call methods of the database.
+type Validator func(k, v []byte) error
+
+// HookContext queues writes of a ContextHookHandler. The queued writes are applied
+// as a WriteBatch right after the write that triggered the hook, or after all writes of
+// a committed transaction, before the lock is released, and can trigger hooks in turn
+// up to the depth set by WithMaxHookDepth.
+// It must not be used after the handler returns.
+type HookContext struct {
+	batch WriteBatch
+	depth int
+}
+
+func (hc *HookContext) Put(k, v []byte) {
+	hc.batch.Put(k, v)
+}
+
+func (hc *HookContext) Delete(k []byte) {
+	hc.batch.Delete(k)
+}
+
+// Depth returns 0 for a hook triggered by a write of the caller of the database,
+// and n+1 for a hook triggered by a write queued by a hook of depth n.
+func (hc *HookContext) Depth() int {
+	return hc.depth
+}
+
+// HookID identifies a hook appended by AppendHook or AppendEventHook.
+type HookID struct {
+	prefix string
+	n      uint64
+}
+
+// Op is the kind of write that triggered an Event.
+type Op int
+
+const (
+	OpPut Op = iota + 1
+	OpDelete
+	// OpExpire is the removal of a key whose ttl has passed.
+	OpExpire
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	case OpExpire:
+		return "expire"
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// Event describes a write passed to an EventHandler.
+type Event struct {
+	Op  Op
+	Key []byte
+	// Value is the new value. It is nil for OpDelete and OpExpire.
+	Value []byte
+	// Prev is the value before the write. It is nil if the key did not exist.
+	Prev []byte
+	// Seq is the sequence number assigned to the write.
+	// It increases monotonically over the lifetime of the database, including reopens
+	// of a persistent database, and the writes committed by one transaction get consecutive numbers.
+	Seq uint64
+}
+
+// KV is a key and its value yielded by QueryKV.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
 type HookDB struct {
 	*DB
 }
 
-func New() *HookDB {
+func New(opts ...Option) *HookDB {
+	var o Options
+	for _, opt := range opts {
+		_ = opt(&o)
+	}
+	return &HookDB{
+		DB: &DB{
+			l3: newL3Store(&o),
+		},
+	}
+}
+
+// Open returns a HookDB persisted in dir.
+// Every mutation is appended to a write-ahead log in dir,
+// and the log is replayed to restore the keys when the database is opened again.
+// The returned database must be closed by Close.
+func Open(dir string, opts ...Option) (*HookDB, error) {
+	var o Options
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	s := newL3Store(&o)
+	w, err := openWAL(dir, s.replay)
+	if err != nil {
+		return nil, err
+	}
+	w.setSyncMode(o.SyncMode, o.getSyncInterval())
+	s.wal = w
+	s.resumeReaper()
 	return &HookDB{
 		DB: &DB{
-			l3: newL3Store(),
+			l3: s,
 		},
+	}, nil
+}
+
+// Restore returns an in-memory HookDB holding the keys of a snapshot written by DB.Snapshot.
+func Restore(r io.Reader, opts ...Option) (*HookDB, error) {
+	var o Options
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	s := newL3Store(&o)
+	if _, err := readWAL(r, s.replay); err != nil {
+		return nil, err
 	}
+	s.resumeReaper()
+	return &HookDB{
+		DB: &DB{
+			l3: s,
+		},
+	}, nil
+}
+
+// Close stops the background removal of expired keys and the workers of async hooks
+// after the queued events are delivered, and flushes and closes the write-ahead log
+// of a persistent database. Writes to a closed database fail with ErrClosed, and events
+// of writes racing with Close may not be delivered to async hooks.
+// Closing a closed database does nothing.
+func (db *HookDB) Close() error {
+	return db.l3.(*l3Store).Close()
 }
 
 func (db *HookDB) Transaction() *Transaction {
@@ -36,16 +191,141 @@ func (db *HookDB) TransactionWithLock() *Transaction {
 	}
 }
 
+// NewSnapshot returns a read-only view of the database at this point.
+// Writes after NewSnapshot are not visible in the snapshot, and keys with a ttl
+// are alive or expired as of this point.
+// The snapshot must be released by Release.
+func (db *HookDB) NewSnapshot() *Snapshot {
+	return &Snapshot{
+		l3: db.l3.(*l3Store).snapshot(),
+	}
+}
+
+// View calls fn with a read-only view of the database, which is released when fn returns.
+func (db *HookDB) View(fn func(ReadTx) error) error {
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	return fn(snap)
+}
+
+// Update runs fn in a Transaction and commits it if fn returns nil.
+// If fn returns an error or panics, the transaction is rolled back
+// and the error is returned or the panic is continued.
+// If the commit fails with ErrConflict, fn is run again in a new transaction after a short
+// random backoff, so fn must not have side effects other than on the transaction.
+// After the retries set by WithMaxUpdateRetries, Update returns ErrConflict.
+func (db *HookDB) Update(fn func(*Transaction) error) error {
+	backoff := time.Millisecond
+	for retries := db.l3.(*l3Store).maxUpdateRetries; ; retries-- {
+		txn := db.Transaction()
+		if err := txn.run(fn); err != nil {
+			return err
+		}
+		err := txn.Commit()
+		if !errors.Is(err, ErrConflict) || retries == 0 {
+			return err
+		}
+		time.Sleep(rand.N(backoff))
+		backoff = min(2*backoff, 100*time.Millisecond)
+	}
+}
+
+// ReadTx is the read-only view of the database passed to the function of View.
+type ReadTx interface {
+	Get(k []byte) ([]byte, error)
+	Query(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[[]byte, error]
+	QueryRange(ctx context.Context, start, end []byte, opts ...QueryOption) iter.Seq2[[]byte, error]
+	QueryKV(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[KV, error]
+}
+
 type Transaction struct {
 	*DB
 }
 
+// Savepoint marks a state of a Transaction to roll back to by RollbackTo.
+type Savepoint struct {
+	n      uint64
+	values int64
+	hooks  int64
+}
+
+// Commit applies the writes of the transaction and calls hooks.
+// It fails with ErrConflict, leaving the database unchanged, if a key read or written
+// in the transaction has been put or deleted by others since the transaction began.
+// The writes are applied only after they are written to the write-ahead log, so a commit
+// failing to write the log leaves the database unchanged. Once the writes are applied, Commit
+// succeeds, and errors of hooks, such as ErrHookDepthExceeded, are passed to WithOnHookError.
+//
+// Commit of a nested transaction leaves its writes in the parent transaction.
 func (txn *Transaction) Commit() error {
-	return txn.DB.l3.(*l3TxnStore).Commit()
+	return txn.DB.l3.(l3Txn).Commit()
 }
 
 func (txn *Transaction) Rollback() error {
-	return txn.DB.l3.(*l3TxnStore).Rollback()
+	return txn.DB.l3.(l3Txn).Rollback()
+}
+
+// run calls fn with txn and rolls back txn if fn returns an error or panics.
+func (txn *Transaction) run(fn func(*Transaction) error) error {
+	defer func() {
+		if r := recover(); r != nil {
+			_ = txn.Rollback()
+			panic(r)
+		}
+	}()
+	if err := fn(txn); err != nil {
+		_ = txn.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Savepoint returns a marker of the current state of the transaction.
+func (txn *Transaction) Savepoint() Savepoint {
+	return txn.DB.l3.(l3Txn).Savepoint()
+}
+
+// RollbackTo discards the writes and hooks made in the transaction after sp.
+// Savepoints taken after sp can no longer be used, while sp can be rolled back to again.
+// It returns ErrInvalidSavepoint if sp is discarded or taken in another transaction.
+func (txn *Transaction) RollbackTo(sp Savepoint) error {
+	return txn.DB.l3.(l3Txn).RollbackTo(sp)
+}
+
+// Transaction starts a transaction nested in txn.
+// Its writes are merged into txn on commit, and discarded on rollback
+// without affecting the writes made in txn before it began.
+// txn must not be used until the nested transaction is committed or rolled back.
+func (txn *Transaction) Transaction() *Transaction {
+	return &Transaction{
+		DB: &DB{
+			l3: txn.DB.l3.(l3Txn).Nested(),
+		},
+	}
+}
+
+// Snapshot is a read-only view of a HookDB returned by NewSnapshot.
+// Reads after Release return ErrReleasedSnapshot.
+type Snapshot struct {
+	l3 *l3Snapshot
+}
+
+func (snap *Snapshot) Get(k []byte) ([]byte, error) {
+	return snap.l3.Get(k)
+}
+func (snap *Snapshot) Query(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[[]byte, error] {
+	return snap.l3.Query(ctx, k, opts...)
+}
+func (snap *Snapshot) QueryRange(ctx context.Context, start, end []byte, opts ...QueryOption) iter.Seq2[[]byte, error] {
+	return snap.l3.QueryRange(ctx, start, end, opts...)
+}
+func (snap *Snapshot) QueryKV(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[KV, error] {
+	return snap.l3.QueryKV(ctx, k, opts...)
+}
+
+// Release releases the snapshot. It can be called more than once.
+func (snap *Snapshot) Release() {
+	snap.l3.Release()
 }
 
 type (
@@ -54,11 +334,40 @@ type (
 	}
 	l3 interface {
 		Get(k []byte) ([]byte, error)
+		GetContext(ctx context.Context, k []byte) ([]byte, error)
 		Put(k []byte, v []byte) error
+		PutContext(ctx context.Context, k []byte, v []byte) error
+		PutWithTTL(k []byte, v []byte, ttl time.Duration) error
 		Delete(k []byte) error
+		DeleteContext(ctx context.Context, k []byte) error
+		Write(b *WriteBatch) error
+		Merge(k, operand []byte) error
+		CompareAndSwap(k, old, new []byte) (bool, error)
+		PutIfAbsent(k, v []byte) (bool, error)
+		DeleteIfEquals(k, v []byte) (bool, error)
 		Query(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[[]byte, error]
-		AppendHook(prefix []byte, fn HookHandler) error
+		QueryRange(ctx context.Context, start, end []byte, opts ...QueryOption) iter.Seq2[[]byte, error]
+		QueryKV(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[KV, error]
+		AppendHook(prefix []byte, fn HookHandler) (HookID, error)
+		AppendEventHook(prefix []byte, fn EventHandler) (HookID, error)
+		AppendContextHook(prefix []byte, fn ContextHookHandler) (HookID, error)
+		AppendAsyncHook(prefix []byte, fn AsyncHookHandler) (HookID, error)
+		AppendValidator(prefix []byte, fn Validator) (HookID, error)
+		AppendPatternHook(p Pattern, fn EventHandler) (HookID, error)
+		WaitHooks(ctx context.Context) error
 		RemoveHook(prefix []byte) error
+		RemoveHookByID(id HookID) error
+		AppendReplayHook(prefix []byte, r replayRange, replay func([]Event), fn EventHandler) (HookID, error)
+		Snapshot(w io.Writer) error
+		Sync() error
+	}
+	l3Txn interface {
+		l3
+		Commit() error
+		Rollback() error
+		Savepoint() Savepoint
+		RollbackTo(sp Savepoint) error
+		Nested() *l3NestedTxnStore
 	}
 )
 
@@ -68,15 +377,164 @@ func (db *DB) Get(k []byte) ([]byte, error) {
 func (db *DB) Put(k []byte, v []byte) error {
 	return db.l3.Put(k, v)
 }
+
+// GetContext is like Get, but returns the error of ctx if ctx is done
+// while waiting for a write, such as a TransactionWithLock, to finish.
+func (db *DB) GetContext(ctx context.Context, k []byte) ([]byte, error) {
+	return db.l3.GetContext(ctx, k)
+}
+
+// PutContext is like Put, but returns the error of ctx if ctx is done
+// while waiting for other writes, such as a TransactionWithLock, to finish.
+// The key is not put in that case.
+func (db *DB) PutContext(ctx context.Context, k []byte, v []byte) error {
+	return db.l3.PutContext(ctx, k, v)
+}
+
+// PutWithTTL puts the key like Put, and the key expires after ttl.
+// An expired key is no longer returned by Get and Query, and is removed in the background
+// with an OpExpire event. Putting the key again clears the ttl.
+// In a Transaction, the ttl starts when PutWithTTL is called, not on commit.
+func (db *DB) PutWithTTL(k []byte, v []byte, ttl time.Duration) error {
+	return db.l3.PutWithTTL(k, v, ttl)
+}
 func (db *DB) Delete(k []byte) error {
 	return db.l3.Delete(k)
 }
+
+// DeleteContext is like Delete, but returns the error of ctx if ctx is done
+// while waiting for other writes to finish. The key is not deleted in that case.
+func (db *DB) DeleteContext(ctx context.Context, k []byte) error {
+	return db.l3.DeleteContext(ctx, k)
+}
+
+// Write applies the operations of b atomically, logged as one record of the write-ahead log.
+// Unlike Transaction, it does not clone the store, so it is cheap for loading many keys.
+// Only the last operation of each key is applied, and hooks are called once per key
+// in order of those operations.
+func (db *DB) Write(b *WriteBatch) error {
+	return db.l3.Write(b)
+}
+
+// Merge atomically combines operand with the current value of k by the MergeOperator
+// registered by WithMergeOperator for the longest prefix of k, and puts the result to k.
+// Hooks receive the result. It returns ErrNoMergeOperator if no operator matches k.
+func (db *DB) Merge(k, operand []byte) error {
+	return db.l3.Merge(k, operand)
+}
+
+// CompareAndSwap atomically puts new to k if the current value of k is old,
+// and reports whether it did. It does not put a missing key, see PutIfAbsent.
+// Hooks are called only if the value is put.
+func (db *DB) CompareAndSwap(k, old, new []byte) (bool, error) {
+	return db.l3.CompareAndSwap(k, old, new)
+}
+
+// PutIfAbsent atomically puts v to k if k does not exist, and reports whether it did.
+// Hooks are called only if the value is put.
+func (db *DB) PutIfAbsent(k, v []byte) (bool, error) {
+	return db.l3.PutIfAbsent(k, v)
+}
+
+// DeleteIfEquals atomically deletes k if the current value of k is v, and reports whether it did.
+// Hooks are called only if the key is deleted.
+func (db *DB) DeleteIfEquals(k, v []byte) (bool, error) {
+	return db.l3.DeleteIfEquals(k, v)
+}
+
+// Query iterates over the values of the keys with the prefix k in key order.
+// The iteration reads a snapshot taken when it starts, so it is not affected by concurrent writes.
+// It stops and yields the error of ctx once ctx is done.
 func (db *DB) Query(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[[]byte, error] {
 	return db.l3.Query(ctx, k, opts...)
 }
-func (db *DB) AppendHook(prefix []byte, fn HookHandler) error {
+
+// QueryKV is like Query but yields the keys along with the values.
+// With WithKeysOnly, it yields only the keys without reading the values.
+func (db *DB) QueryKV(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[KV, error] {
+	return db.l3.QueryKV(ctx, k, opts...)
+}
+
+// QueryRange iterates over the values of the keys in the half-open range [start, end) in key order.
+// A nil start or end leaves the range unbounded on that side.
+// It accepts the same options as Query.
+func (db *DB) QueryRange(ctx context.Context, start, end []byte, opts ...QueryOption) iter.Seq2[[]byte, error] {
+	return db.l3.QueryRange(ctx, start, end, opts...)
+}
+
+// AppendHook registers fn to be called with every put of keys with the prefix.
+// Any number of hooks can be appended to the same prefix. They are called in order of registration.
+// The returned HookID removes this hook by RemoveHookByID.
+func (db *DB) AppendHook(prefix []byte, fn HookHandler) (HookID, error) {
 	return db.l3.AppendHook(prefix, fn)
 }
+
+// AppendEventHook registers fn to be called with every put and delete of keys with the prefix.
+// Deletes in a Transaction trigger fn on commit, like puts.
+func (db *DB) AppendEventHook(prefix []byte, fn EventHandler) (HookID, error) {
+	return db.l3.AppendEventHook(prefix, fn)
+}
+
+// AppendContextHook registers fn to be called with every put, delete and expiry of keys with the prefix.
+// Writes queued by fn through HookContext are applied right after the triggering write.
+// If they cascade beyond WithMaxHookDepth, they are not applied and the triggering write
+// returns ErrHookDepthExceeded, while the writes up to that depth stay applied.
+func (db *DB) AppendContextHook(prefix []byte, fn ContextHookHandler) (HookID, error) {
+	return db.l3.AppendContextHook(prefix, fn)
+}
+
+// AppendAsyncHook registers fn to be called with every put, delete and expiry of keys with the prefix
+// like AppendEventHook, but fn runs on a pool of workers after the write returns, so it does not
+// add to the latency of writes and may use the database. Events of a key are passed in order,
+// while events of different keys may be passed concurrently.
+// Writes wait while more events than set by WithHookQueueSize are queued,
+// except writes with the context passed to fn, which are never blocked by the queue.
+// After fn asks to be removed, it is not called again.
+func (db *DB) AppendAsyncHook(prefix []byte, fn AsyncHookHandler) (HookID, error) {
+	return db.l3.AppendAsyncHook(prefix, fn)
+}
+
+// AppendPatternHook registers fn to be called with every put, delete and expiry of keys
+// matching p, which is made by Glob or Segments, like AppendEventHook.
+// RemoveHook with the literal prefix of p also removes the hook.
+func (db *DB) AppendPatternHook(p Pattern, fn EventHandler) (HookID, error) {
+	return db.l3.AppendPatternHook(p, fn)
+}
+
+// AppendValidator registers fn to check the values put to keys with the prefix, including puts
+// by Merge, WriteBatch, hooks and transactions. If fn returns an error, the write is rejected
+// with the error wrapped in ErrInvalidValue and nothing is written. A rejected write in a
+// transaction rejects the whole transaction on Commit. The validator is removed by RemoveHook
+// or RemoveHookByID with the returned id.
+func (db *DB) AppendValidator(prefix []byte, fn Validator) (HookID, error) {
+	return db.l3.AppendValidator(prefix, fn)
+}
+
+// WaitHooks waits until the events queued for hooks added by AppendAsyncHook are delivered,
+// or ctx is done.
+func (db *DB) WaitHooks(ctx context.Context) error {
+	return db.l3.WaitHooks(ctx)
+}
+
+// RemoveHook removes all hooks of the prefix.
 func (db *DB) RemoveHook(prefix []byte) error {
 	return db.l3.RemoveHook(prefix)
 }
+
+// RemoveHookByID removes the hook identified by id, leaving other hooks of the same prefix.
+func (db *DB) RemoveHookByID(id HookID) error {
+	return db.l3.RemoveHookByID(id)
+}
+
+// Snapshot writes the current keys and values to w in a compact form that can be read by Restore.
+// Overwritten and deleted values are not included.
+func (db *DB) Snapshot(w io.Writer) error {
+	return db.l3.Snapshot(w)
+}
+
+// Sync commits the write-ahead log of a persistent database to stable storage.
+// It also returns the errors of background syncs and log compactions failed since
+// the previous call. It is a no-op for an in-memory database.
+func (db *DB) Sync() error {
+	return db.l3.Sync()
+}
@@ -5,13 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
 
 	"github.com/yyyoichi/hookdb"
 )
 
 func Example() {
 	db := hookdb.New()
-	err := db.AppendHook([]byte("c"), func(k, v []byte) (removeHook bool) {
+	_, err := db.AppendHook([]byte("c"), func(k, v []byte) (removeHook bool) {
 		fmt.Printf("%s: %s\n", k, v)
 		return false
 	})
@@ -114,7 +116,7 @@ func ExampleDB_Delete() {
 
 func ExampleDB_AppendHook() {
 	db := hookdb.New()
-	err := db.AppendHook([]byte("GAME100#ACT"), func(k, v []byte) (removeHook bool) {
+	_, err := db.AppendHook([]byte("GAME100#ACT"), func(k, v []byte) (removeHook bool) {
 		fmt.Printf("%s..ACTION '%s'!\n", k, v)
 		return false
 	})
@@ -145,7 +147,7 @@ func ExampleDB_AppendHook() {
 
 func ExampleDB_AppendHook_removal() {
 	db := hookdb.New()
-	err := db.AppendHook([]byte("SHOP200#ORDER"), func(k, v []byte) (removeHook bool) {
+	_, err := db.AppendHook([]byte("SHOP200#ORDER"), func(k, v []byte) (removeHook bool) {
 		fmt.Printf("%s..ORDER '%s'!\n", k, v)
 		return true // !
 	})
@@ -222,7 +224,7 @@ func ExampleHookDB_AppendHook_withTransaction() {
 	db := hookdb.New()
 
 	var count int
-	err := db.AppendHook([]byte("pen"), func(k, v []byte) (removeHook bool) {
+	_, err := db.AppendHook([]byte("pen"), func(k, v []byte) (removeHook bool) {
 		fmt.Printf("'%s'\n", v)
 		count++
 		return false
@@ -481,3 +483,279 @@ func ExampleDB_Subscribe_once() {
 	// shoes
 
 }
+
+func ExampleOpen() {
+	dir, err := os.MkdirTemp("", "hookdb")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := hookdb.Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Put([]byte("town"), []byte("Yokohama"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// reopen
+	db, err = hookdb.Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	v, err := db.Get([]byte("town"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(v))
+
+	// Output:
+	// Yokohama
+}
+
+func ExampleDB_AppendEventHook() {
+	db := hookdb.New()
+	_, err := db.AppendEventHook([]byte("GAME100#"), func(e hookdb.Event) (removeHook bool) {
+		switch e.Op {
+		case hookdb.OpPut:
+			fmt.Printf("%s: put '%s'\n", e.Key, e.Value)
+		case hookdb.OpDelete:
+			fmt.Printf("%s: delete '%s'\n", e.Key, e.Prev)
+		}
+		return false
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Put([]byte("GAME100#ACT1"), []byte("KICK"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Delete([]byte("GAME100#ACT1"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// GAME100#ACT1: put 'KICK'
+	// GAME100#ACT1: delete 'KICK'
+}
+
+func ExampleDB_SubscribeEvents() {
+	db := hookdb.New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	event, err := db.SubscribeEvents(ctx, []byte("GAME100#ACT"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range event {
+			fmt.Printf("%d %s %s '%s'\n", e.Seq, e.Op, e.Key, e.Value)
+			if e.Op == hookdb.OpDelete {
+				cancel()
+			}
+		}
+	}()
+	err = db.Put([]byte("GAME100#ACT1"), []byte("KICK"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Put([]byte("GAME100#ACT2"), []byte("PUNCH"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Delete([]byte("GAME100#ACT1"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	<-done
+
+	// Output:
+	// 1 put GAME100#ACT1 'KICK'
+	// 2 put GAME100#ACT2 'PUNCH'
+	// 3 delete GAME100#ACT1 ''
+}
+
+func ExampleDB_QueryRange() {
+	db := hookdb.New()
+
+	for i := range 10 {
+		key := fmt.Sprintf("GAME100#ACT%03d", i)
+		err := db.Put([]byte(key), []byte(key))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// page through [ACT002, ACT008) by 3 keys
+	ctx := context.Background()
+	start, end := []byte("GAME100#ACT002"), []byte("GAME100#ACT008")
+	var last []byte
+	for page := 1; ; page++ {
+		opts := []hookdb.QueryOption{hookdb.WithLimit(3)}
+		if last != nil {
+			opts = append(opts, hookdb.WithStartAfter(last))
+		}
+		var n int
+		for v, err := range db.QueryRange(ctx, start, end, opts...) {
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("page%d: %s\n", page, v)
+			last = v
+			n++
+		}
+		if n < 3 {
+			break
+		}
+	}
+
+	// Output:
+	// page1: GAME100#ACT002
+	// page1: GAME100#ACT003
+	// page1: GAME100#ACT004
+	// page2: GAME100#ACT005
+	// page2: GAME100#ACT006
+	// page2: GAME100#ACT007
+}
+
+func ExampleDB_QueryKV() {
+	db := hookdb.New()
+
+	for i, item := range []string{"shoes", "hat", "gloves"} {
+		key := fmt.Sprintf("ORDER%03d", i)
+		err := db.Put([]byte(key), []byte(item))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	for kv, err := range db.QueryKV(ctx, []byte("ORDER")) {
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: %s\n", kv.Key, kv.Value)
+	}
+	// keys only
+	for kv, err := range db.QueryKV(ctx, []byte("ORDER"), hookdb.WithKeysOnly(), hookdb.WithReverseQuery()) {
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: %v\n", kv.Key, kv.Value == nil)
+	}
+
+	// Output:
+	// ORDER000: shoes
+	// ORDER001: hat
+	// ORDER002: gloves
+	// ORDER002: true
+	// ORDER001: true
+	// ORDER000: true
+}
+
+func ExampleHookDB_NewSnapshot() {
+	db := hookdb.New()
+
+	err := db.Put([]byte("STOCK#shoes"), []byte("10"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	snap := db.NewSnapshot()
+	defer snap.Release()
+
+	err = db.Put([]byte("STOCK#shoes"), []byte("9"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	old, err := snap.Get([]byte("STOCK#shoes"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cur, err := db.Get([]byte("STOCK#shoes"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("snapshot: %s, current: %s\n", old, cur)
+
+	// Output:
+	// snapshot: 10, current: 9
+}
+
+func ExampleHookDB_Update() {
+	db := hookdb.New()
+
+	err := db.Put([]byte("STOCK#shoes"), []byte("10"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// decrement the stock, retried if another transaction changes it concurrently
+	err = db.Update(func(txn *hookdb.Transaction) error {
+		v, err := txn.Get([]byte("STOCK#shoes"))
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(string(v))
+		if err != nil {
+			return err
+		}
+		return txn.Put([]byte("STOCK#shoes"), []byte(strconv.Itoa(n-1)))
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.View(func(tx hookdb.ReadTx) error {
+		v, err := tx.Get([]byte("STOCK#shoes"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("stock: %s\n", v)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// stock: 9
+}
+
+func ExampleDB_AppendPatternHook() {
+	db := hookdb.New()
+	// ACT keys of every game
+	_, err := db.AppendPatternHook(hookdb.Glob([]byte("GAME*#ACT*")), func(e hookdb.Event) (removeHook bool) {
+		fmt.Printf("%s: %s '%s'\n", e.Key, e.Op, e.Value)
+		return false
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, k := range []string{"GAME100#ACT1", "GAME100#SCORE", "GAME200#ACT1"} {
+		err = db.Put([]byte(k), []byte("KICK"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Output:
+	// GAME100#ACT1: put 'KICK'
+	// GAME200#ACT1: put 'KICK'
+}
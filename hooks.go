@@ -2,50 +2,93 @@ package hookdb
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 )
 
 // Subscribe subscribes to events with the given prefix and sends the data to the returned channel.
 // If default option is used, the returned channel will not close until the provided context is done.
 func (db *DB) Subscribe(ctx context.Context, prefix []byte, opts ...SubscribeOption) (<-chan []byte, error) {
+	return subscribe(ctx, db, prefix, opts, func(e Event) ([]byte, bool) {
+		return e.Value, e.Op == OpPut
+	})
+}
+
+// SubscribeEvents is like Subscribe but sends every put and delete of keys with the prefix as an Event.
+// Events are sent in order of Event.Seq.
+func (db *DB) SubscribeEvents(ctx context.Context, prefix []byte, opts ...SubscribeOption) (<-chan Event, error) {
+	return subscribe(ctx, db, prefix, opts, func(e Event) (Event, bool) {
+		return e, true
+	})
+}
+
+// subscribe sends the events converted by conv to the returned channel.
+// Events for which conv returns false are not sent.
+func subscribe[T any](ctx context.Context, db *DB, prefix []byte, opts []SubscribeOption, conv func(Event) (T, bool)) (<-chan T, error) {
 	var so SubscribeOptions
 	for _, opt := range opts {
 		_ = opt(&so)
 	}
 
-	var p = pipe{
-		ch: make(chan []byte),
-	}
-	var ch = make(chan []byte, so.getBufSize())
-	err := db.AppendHook(prefix, func(k, v []byte) bool {
+	var p = newPipe[T](so.getBufSize(), so.OverflowPolicy, so.Stats)
+	var ch = make(chan T)
+	fn := func(e Event) bool {
+		v, ok := conv(e)
+		if !ok {
+			return false
+		}
 		select {
 		case <-ctx.Done():
 			return false
 		default:
-			p.recieve(v)
+			// remove the hook once the subscription is closed
+			return !p.recieve(v)
 		}
-		return false
-	})
+	}
+	var (
+		id  HookID
+		err error
+	)
+	switch {
+	case so.StartFrom != nil && so.ReplayExisting:
+		err = errors.New("WithStartFrom and WithReplayExisting cannot be used together")
+	case so.StartFrom != nil || so.ReplayExisting:
+		var r replayRange
+		if so.StartFrom != nil {
+			r.from = max(*so.StartFrom, 1)
+		}
+		r.existing = so.ReplayExisting
+		id, err = db.l3.AppendReplayHook(prefix, r, func(events []Event) {
+			for _, e := range events {
+				if v, ok := conv(e); ok {
+					p.preload(v)
+				}
+			}
+		}, fn)
+	default:
+		id, err = db.AppendEventHook(prefix, fn)
+	}
 	if err != nil {
-		p.close()
+		p.close(nil)
 		close(ch)
 		return nil, err
 	}
 	go func() {
 		defer func() {
-			p.close()
+			p.close(nil)
 			close(ch)
-			_ = db.RemoveHook(prefix)
+			_ = db.RemoveHookByID(id)
 		}()
 		for {
+			v, ok := p.pop(ctx)
+			if !ok {
+				return
+			}
 			select {
 			case <-ctx.Done():
 				return
-			case v, ok := <-p.ch:
-				if !ok {
-					return
-				}
-				ch <- v
+			case ch <- v:
 			}
 			if so.Once {
 				return
@@ -55,28 +98,157 @@ func (db *DB) Subscribe(ctx context.Context, prefix []byte, opts ...SubscribeOpt
 	return ch, nil
 }
 
-type pipe struct {
-	ch chan []byte
+// SubscriptionStats reports the state of a subscription. See WithSubscriptionStats.
+type SubscriptionStats struct {
+	dropped atomic.Uint64
+
+	err error
+	mu  sync.Mutex // mu for err
+}
+
+// Dropped returns the number of events dropped by OverflowDropNewest or OverflowDropOldest.
+func (s *SubscriptionStats) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Err returns ErrSlowSubscriber if the subscription was closed by OverflowDisconnect.
+func (s *SubscriptionStats) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// pipe is a bounded queue between hooks, which are called by writers, and a subscriber.
+type pipe[T any] struct {
+	size   int
+	policy OverflowPolicy
+	stats  *SubscriptionStats
+
+	// pushed and popped notify waiters of the other side
+	pushed chan struct{}
+	popped chan struct{}
+	closed chan struct{}
 
+	buf  []T
 	done bool
-	mu   sync.RWMutex // mu for done
+	mu   sync.Mutex // mu for buf and done
 }
 
-func (p *pipe) recieve(v []byte) {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	if p.done {
-		return
+func newPipe[T any](size int, policy OverflowPolicy, stats *SubscriptionStats) *pipe[T] {
+	if stats == nil {
+		stats = &SubscriptionStats{}
+	}
+	return &pipe[T]{
+		size:   max(size, 1),
+		policy: policy,
+		stats:  stats,
+		pushed: make(chan struct{}, 1),
+		popped: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		buf:    make([]T, 0, max(size, 1)),
 	}
-	p.ch <- v
 }
 
-func (p *pipe) close() {
+// recieve queues v following the overflow policy.
+// It returns false if the pipe is closed.
+func (p *pipe[T]) recieve(v T) bool {
+	for {
+		p.mu.Lock()
+		if p.done {
+			p.mu.Unlock()
+			return false
+		}
+		if len(p.buf) < p.size {
+			p.buf = append(p.buf, v)
+			p.mu.Unlock()
+			notify(p.pushed)
+			return true
+		}
+		switch p.policy {
+		case OverflowDropNewest:
+			p.mu.Unlock()
+			p.stats.dropped.Add(1)
+			return true
+		case OverflowDropOldest:
+			p.buf = append(p.buf[1:], v)
+			p.mu.Unlock()
+			p.stats.dropped.Add(1)
+			notify(p.pushed)
+			return true
+		case OverflowDisconnect:
+			p.closeLocked(ErrSlowSubscriber)
+			p.mu.Unlock()
+			return false
+		}
+		// OverflowBlock
+		p.mu.Unlock()
+		<-p.popped
+	}
+}
+
+// preload queues v regardless of the size of the pipe.
+// It is used for past events sent before live ones.
+func (p *pipe[T]) preload(v T) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, v)
+	notify(p.pushed)
+}
+
+// pop returns the oldest value in the pipe, waiting for one if the pipe is empty.
+// Values queued before the pipe is closed are still returned.
+// It returns false if ctx is done or the pipe is closed and empty.
+func (p *pipe[T]) pop(ctx context.Context) (v T, ok bool) {
+	for {
+		if ctx.Err() != nil {
+			return v, false
+		}
+		p.mu.Lock()
+		if len(p.buf) > 0 {
+			v = p.buf[0]
+			p.buf = p.buf[1:]
+			p.mu.Unlock()
+			notify(p.popped)
+			return v, true
+		}
+		if p.done {
+			p.mu.Unlock()
+			return v, false
+		}
+		p.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-p.pushed:
+		case <-p.closed:
+		}
+	}
+}
+
+func (p *pipe[T]) close(err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.closeLocked(err)
+}
+
+func (p *pipe[T]) closeLocked(err error) {
 	if p.done {
 		return
 	}
 	p.done = true
-	close(p.ch)
+	if err != nil {
+		p.stats.mu.Lock()
+		p.stats.err = err
+		p.stats.mu.Unlock()
+	}
+	close(p.closed)
+	// wake up a blocked writer
+	notify(p.popped)
+}
+
+// notify wakes up a waiter of ch without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
 }
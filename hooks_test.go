@@ -0,0 +1,210 @@
+package hookdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeOverflow(t *testing.T) {
+	put := func(t *testing.T, db *HookDB, n int) []string {
+		t.Helper()
+		want := make([]string, 0, n)
+		for i := range n {
+			v := fmt.Sprintf("order%d", i+1)
+			assert.NoError(t, db.Put([]byte(v), []byte(v)))
+			want = append(want, v)
+		}
+		return want
+	}
+	// receive reads ch until no value arrives for a while
+	receive := func(ch <-chan []byte) []string {
+		var got []string
+		for {
+			select {
+			case v, ok := <-ch:
+				if !ok {
+					return got
+				}
+				got = append(got, string(v))
+			case <-time.After(50 * time.Millisecond):
+				return got
+			}
+		}
+	}
+
+	t.Run("drop newest", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var stats SubscriptionStats
+		ch, err := db.Subscribe(context.Background(), []byte("order"),
+			WithBufSize(2), WithOverflowPolicy(OverflowDropNewest), WithSubscriptionStats(&stats))
+		assert.NoError(t, err)
+
+		want := put(t, db, 10)
+		got := receive(ch)
+		assert.Equal(t, want[:len(got)], got)
+		assert.NotZero(t, stats.Dropped())
+		assert.Equal(t, uint64(len(want)-len(got)), stats.Dropped())
+		assert.NoError(t, stats.Err())
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var stats SubscriptionStats
+		ch, err := db.Subscribe(context.Background(), []byte("order"),
+			WithBufSize(2), WithOverflowPolicy(OverflowDropOldest), WithSubscriptionStats(&stats))
+		assert.NoError(t, err)
+
+		want := put(t, db, 10)
+		got := receive(ch)
+		assert.Equal(t, want[len(want)-2:], got[len(got)-2:])
+		assert.NotZero(t, stats.Dropped())
+		assert.Equal(t, uint64(len(want)-len(got)), stats.Dropped())
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var stats SubscriptionStats
+		ch, err := db.Subscribe(context.Background(), []byte("order"),
+			WithBufSize(2), WithOverflowPolicy(OverflowDisconnect), WithSubscriptionStats(&stats))
+		assert.NoError(t, err)
+
+		want := put(t, db, 10)
+		var got []string
+		for v := range ch {
+			got = append(got, string(v))
+		}
+		assert.Equal(t, want[:len(got)], got)
+		assert.Less(t, len(got), len(want))
+		assert.ErrorIs(t, stats.Err(), ErrSlowSubscriber)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		ch, err := db.Subscribe(context.Background(), []byte("order"), WithBufSize(2))
+		assert.NoError(t, err)
+
+		done := make(chan []string)
+		go func() {
+			done <- put(t, db, 10)
+		}()
+		var got []string
+		for range 10 {
+			got = append(got, string(<-ch))
+		}
+		assert.Equal(t, <-done, got)
+	})
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	t.Run("start from", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithChangeLogSize(4))
+		assert.NoError(t, db.Put([]byte("order1"), []byte("shoes")))  // seq 1
+		assert.NoError(t, db.Put([]byte("item1"), []byte("shoes")))   // seq 2
+		assert.NoError(t, db.Put([]byte("order2"), []byte("hat")))    // seq 3
+		assert.NoError(t, db.Delete([]byte("order1")))                // seq 4
+		assert.NoError(t, db.Put([]byte("order3"), []byte("gloves"))) // seq 5
+
+		_, err := db.SubscribeEvents(context.Background(), []byte("order"), WithStartFrom(1))
+		assert.ErrorIs(t, err, ErrSeqNotRetained)
+		_, err = db.SubscribeEvents(context.Background(), []byte("order"), WithStartFrom(100))
+		assert.ErrorIs(t, err, ErrFutureSeq)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch, err := db.SubscribeEvents(ctx, []byte("order"), WithStartFrom(3), WithBufSize(8))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("order4"), []byte("socks"))) // seq 6
+
+		var got []string
+		for range 4 {
+			e := <-ch
+			got = append(got, fmt.Sprintf("%d %s %s", e.Seq, e.Op, e.Key))
+		}
+		assert.Equal(t, []string{
+			"3 put order2",
+			"4 delete order1",
+			"5 put order3",
+			"6 put order4",
+		}, got)
+	})
+
+	t.Run("replay existing", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		assert.NoError(t, db.Put([]byte("order2"), []byte("hat")))
+		assert.NoError(t, db.Put([]byte("order1"), []byte("shoes")))
+		assert.NoError(t, db.Put([]byte("item1"), []byte("shoes")))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch, err := db.Subscribe(ctx, []byte("order"), WithReplayExisting(), WithBufSize(8))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("order3"), []byte("gloves")))
+
+		var got []string
+		for range 3 {
+			got = append(got, string(<-ch))
+		}
+		assert.Equal(t, []string{"shoes", "hat", "gloves"}, got)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		t.Parallel()
+		for _, size := range []int64{64 << 20, 1} {
+			dir := t.TempDir()
+			lastSeq := func(db *HookDB) uint64 {
+				var seq uint64
+				id, err := db.AppendEventHook([]byte("seq"), func(e Event) bool {
+					seq = e.Seq
+					return false
+				})
+				assert.NoError(t, err)
+				assert.NoError(t, db.Put([]byte("seq"), nil))
+				assert.NoError(t, db.RemoveHookByID(id))
+				return seq
+			}
+			db, err := Open(dir, WithCompactionSize(size))
+			require.NoError(t, err)
+			assert.NoError(t, db.Put([]byte("order1"), []byte("shoes")))
+			assert.NoError(t, db.Delete([]byte("order1")))
+			var b WriteBatch
+			b.Put([]byte("order2"), []byte("hat"))
+			b.Put([]byte("order3"), []byte("gloves"))
+			assert.NoError(t, db.Write(&b))
+			// no event for a key put and deleted in a transaction
+			txn := db.Transaction()
+			assert.NoError(t, txn.Put([]byte("order4"), []byte("socks")))
+			assert.NoError(t, txn.Delete([]byte("order4")))
+			assert.NoError(t, txn.Delete([]byte("order2")))
+			assert.NoError(t, txn.Commit())
+			assert.Equal(t, uint64(6), lastSeq(db), size)
+			require.NoError(t, db.Close())
+
+			db, err = Open(dir, WithCompactionSize(size))
+			require.NoError(t, err)
+			assert.Equal(t, uint64(7), lastSeq(db), size)
+			_, err = db.SubscribeEvents(context.Background(), []byte("order"), WithStartFrom(6))
+			assert.ErrorIs(t, err, ErrSeqNotRetained)
+			_, err = db.SubscribeEvents(context.Background(), []byte("order"), WithStartFrom(8))
+			assert.NoError(t, err)
+			require.NoError(t, db.Close())
+		}
+	})
+
+	t.Run("exclusive options", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		_, err := db.Subscribe(context.Background(), []byte("order"), WithReplayExisting(), WithStartFrom(1))
+		assert.Error(t, err)
+	})
+}
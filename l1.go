@@ -17,7 +17,18 @@ type (
 		mu       sync.RWMutex
 		vals     map[int64]T
 		keys     map[int64][]byte
-		btree    *btree.BTreeG[*item]
+		// expiry deadlines in unix nano of entries put with a ttl
+		exps  map[int64]int64
+		btree *btree.BTreeG[*item]
+		// snapshots is the number of open snapshots
+		snapshots int
+		// frozen keeps the entries deleted or changed while snapshots are open
+		frozen map[int64]frozenEntry[T]
+	}
+	frozenEntry[T any] struct {
+		k   []byte
+		v   T
+		exp int64
 	}
 	// bree item
 	item struct {
@@ -31,6 +42,8 @@ type (
 		k []byte
 		v T
 		i int64
+		// expiry deadline in unix nano, 0 for no expiry
+		exp int64
 	}
 
 	output[T any] struct {
@@ -38,6 +51,7 @@ type (
 		val     T
 		i       int64
 		deleted bool
+		exp     int64
 	}
 
 	command[T any] func(input[T]) (output[T], error)
@@ -57,6 +71,8 @@ func newL1Store[T any](opts ...storeOptionF) *l1BaseStore[T] {
 		iCounter: op.iCounter,
 		vals:     map[int64]T{},
 		keys:     map[int64][]byte{},
+		exps:     map[int64]int64{},
+		frozen:   map[int64]frozenEntry[T]{},
 		btree: btree.NewG(2, func(a, b *item) bool {
 			return bytes.Compare(a.k, b.k) == -1
 		}),
@@ -97,17 +113,35 @@ func (s *l1BaseStore[T]) put(in input[T]) (o output[T], err error) {
 	i := s.nextI
 	s.keys[i] = in.k
 	s.vals[i] = in.v
-	_, _ = s.btree.ReplaceOrInsert(&item{k: in.k, i: i})
+	if in.exp != 0 {
+		s.exps[i] = in.exp
+	}
+	if old, found := s.btree.ReplaceOrInsert(&item{k: in.k, i: i}); found {
+		// the old entry no longer expires
+		s.freeze(old.i)
+		delete(s.exps, old.i)
+	}
 	s.iCounter(&s.nextI)
 
 	o.key = in.k
 	o.val = in.v
 	o.i = i
 	o.deleted = false
+	o.exp = in.exp
 	return o, nil
 }
 
 func (s *l1BaseStore[T]) get(in input[T]) (o output[T], err error) {
+	o, err = s.head(in)
+	if err != nil {
+		return
+	}
+	o.val = s.vals[o.i]
+	return
+}
+
+// head is like get but does not read the value.
+func (s *l1BaseStore[T]) head(in input[T]) (o output[T], err error) {
 	switch {
 	case in.i != 0:
 		k, found := s.keys[in.i]
@@ -131,7 +165,7 @@ func (s *l1BaseStore[T]) get(in input[T]) (o output[T], err error) {
 	if err != nil {
 		return
 	}
-	o.val = s.vals[o.i]
+	o.exp = s.exps[o.i]
 	return
 }
 
@@ -162,23 +196,140 @@ func (s *l1BaseStore[T]) delete(in input[T]) (o output[T], err error) {
 	}
 	o.deleted = true
 	o.val = s.vals[o.i]
+	o.exp = s.exps[o.i]
+	s.freeze(o.i)
 	delete(s.vals, o.i)
 	delete(s.keys, o.i)
+	delete(s.exps, o.i)
 	return
 }
 
-func (s *l1BaseStore[T]) Commit() (os []output[T], err error) {
-	return
+// freeze keeps the entry of i for open snapshots before it is deleted or changed.
+func (s *l1BaseStore[T]) freeze(i int64) {
+	if s.snapshots == 0 {
+		return
+	}
+	if _, found := s.frozen[i]; found {
+		return
+	}
+	s.frozen[i] = frozenEntry[T]{k: s.keys[i], v: s.vals[i], exp: s.exps[i]}
 }
 
-func (s *l1BaseStore[T]) Rollback() error {
-	return nil
+// snapshot returns a read-only view of the store at this point.
+// It must be released by release.
+func (s *l1BaseStore[T]) snapshot() *l1Snapshot[T] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots++
+	return &l1Snapshot[T]{
+		origin: s,
+		btree:  s.btree.Clone(),
+	}
+}
+
+// l1Snapshot reads the entries of a cloned btree. Entries deleted or changed
+// in the origin store after the clone are read from the frozen entries.
+type l1Snapshot[T any] struct {
+	origin   *l1BaseStore[T]
+	btree    *btree.BTreeG[*item]
+	released bool
+}
+
+func (s *l1Snapshot[T]) Btree() *btree.BTreeG[*item] {
+	return s.btree
+}
+
+func (s *l1Snapshot[T]) get(in input[T]) (o output[T], err error) {
+	return s.lookup(in, true)
+}
+
+// head is like get but does not read the value.
+func (s *l1Snapshot[T]) head(in input[T]) (o output[T], err error) {
+	return s.lookup(in, false)
+}
+
+// lookup finds the entry of in, and reads its value if withValue is true.
+func (s *l1Snapshot[T]) lookup(in input[T], withValue bool) (o output[T], err error) {
+	s.origin.mu.RLock()
+	defer s.origin.mu.RUnlock()
+	if s.released {
+		return o, ErrReleasedSnapshot
+	}
+	o.i = in.i
+	if o.i == 0 {
+		if len(in.k) == 0 {
+			return o, ErrEmptyEntry
+		}
+		item, found := s.btree.Get(&item{k: in.k})
+		if !found {
+			return o, ErrKeyNotFound
+		}
+		o.i = item.i
+	}
+	if e, found := s.origin.frozen[o.i]; found {
+		o.key, o.exp = e.k, e.exp
+		if withValue {
+			o.val = e.v
+		}
+		return o, nil
+	}
+	k, found := s.origin.keys[o.i]
+	if !found {
+		return o, ErrKeyNotFound
+	}
+	o.key, o.exp = k, s.origin.exps[o.i]
+	if withValue {
+		o.val = s.origin.vals[o.i]
+	}
+	return o, nil
+}
+
+// release closes the snapshot. The frozen entries are dropped when no snapshot is open.
+func (s *l1Snapshot[T]) release() {
+	s.origin.mu.Lock()
+	defer s.origin.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	s.origin.snapshots--
+	if s.origin.snapshots == 0 {
+		clear(s.origin.frozen)
+	}
+}
+
+// expired returns the entries whose expiry deadline is at or before now.
+func (s *l1BaseStore[T]) expired(now int64) []output[T] {
+	var outputs []output[T]
+	for i, exp := range s.exps {
+		if now < exp {
+			continue
+		}
+		outputs = append(outputs, output[T]{key: s.keys[i], val: s.vals[i], i: i, exp: exp})
+	}
+	return outputs
+}
+
+func (s *l1BaseStore[T]) Commit() (os []output[T], err error) {
+	return
 }
 
 type l1TxnStore[T any] struct {
 	origin *l1BaseStore[T]
 	*l1BaseStore[T]
 	dels map[int64]bool
+	// reads maps the keys read or written by the transaction to the i of the entry
+	// in the origin store when the transaction began, or 0 if the key did not exist
+	reads map[string]int64
+	// undo maps the entries of the transaction to the entries they replaced in the btree
+	undo map[int64]undoEntry
+}
+
+// undoEntry is the btree item replaced by a write in a transaction and its expiry.
+// The item is nil if the key did not exist.
+type undoEntry struct {
+	item *item
+	exp  int64
 }
 
 func newL1TxnStore[T any](origin *l1BaseStore[T]) *l1TxnStore[T] {
@@ -186,7 +337,11 @@ func newL1TxnStore[T any](origin *l1BaseStore[T]) *l1TxnStore[T] {
 		origin:      origin,
 		l1BaseStore: newL1Store[T](withDownCounter()),
 		dels:        make(map[int64]bool),
+		reads:       make(map[string]int64),
+		undo:        make(map[int64]undoEntry),
 	}
+	s.origin.mu.Lock()
+	defer s.origin.mu.Unlock()
 	s.l1BaseStore.btree = s.origin.btree.Clone()
 	return s
 }
@@ -196,23 +351,84 @@ func (s *l1TxnStore[T]) Btree() *btree.BTreeG[*item] {
 }
 
 func (s *l1TxnStore[T]) put(in input[T]) (output[T], error) {
-	o, _ := s.l1BaseStore.put(in)
+	if len(in.k) != 0 {
+		s.observeKey(in.k)
+	}
+	o, _ := s.write(in)
 	s.dels[o.i] = false
 	return o, nil
 }
 
+// write puts in to the transaction keeping the replaced entry for truncate.
+func (s *l1TxnStore[T]) write(in input[T]) (output[T], error) {
+	var u undoEntry
+	if old, found := s.l1BaseStore.btree.Get(&item{k: in.k}); found {
+		u = undoEntry{item: old, exp: s.l1BaseStore.exps[old.i]}
+	}
+	o, err := s.l1BaseStore.put(in)
+	if err != nil {
+		return o, err
+	}
+	s.undo[o.i] = u
+	return o, nil
+}
+
+// truncate discards the entries written after nextI was i, newest first,
+// and restores the btree items they replaced.
+func (s *l1TxnStore[T]) truncate(i int64) {
+	s.l1BaseStore.mu.Lock()
+	defer s.l1BaseStore.mu.Unlock()
+	for j := s.l1BaseStore.nextI + 1; j <= i; j++ {
+		u := s.undo[j]
+		if u.item != nil {
+			s.l1BaseStore.btree.ReplaceOrInsert(u.item)
+			if u.exp != 0 {
+				s.l1BaseStore.exps[u.item.i] = u.exp
+			}
+		} else {
+			s.l1BaseStore.btree.Delete(&item{k: s.l1BaseStore.keys[j]})
+		}
+		delete(s.l1BaseStore.keys, j)
+		delete(s.l1BaseStore.vals, j)
+		delete(s.l1BaseStore.exps, j)
+		delete(s.dels, j)
+		delete(s.undo, j)
+	}
+	s.l1BaseStore.nextI = max(s.l1BaseStore.nextI, i)
+}
+
 func (s *l1TxnStore[T]) get(in input[T]) (o output[T], err error) {
+	return s.lookup(in, (*l1BaseStore[T]).get)
+}
+
+func (s *l1TxnStore[T]) head(in input[T]) (o output[T], err error) {
+	return s.lookup(in, (*l1BaseStore[T]).head)
+}
+
+// lookup finds the entry in the origin or the transaction by fetch, which is get or head.
+func (s *l1TxnStore[T]) lookup(in input[T], fetch func(*l1BaseStore[T], input[T]) (output[T], error)) (o output[T], err error) {
+	// the origin store is written concurrently by others
+	s.origin.mu.RLock()
+	defer s.origin.mu.RUnlock()
 	switch {
 	case 0 < in.i:
-		o, err = s.origin.get(in)
+		o, err = fetch(s.origin, in)
+		if err == nil {
+			s.observe(o.key, o.i)
+		}
 	case in.i < 0:
-		o, err = s.l1BaseStore.get(in)
+		o, err = fetch(s.l1BaseStore, in)
 	default:
 		// get with key, btree is cloned
-		o, err = s.l1BaseStore.get(in)
+		o, err = fetch(s.l1BaseStore, in)
+		if errors.Is(err, ErrKeyNotFound) {
+			s.observe(in.k, 0)
+		}
 		// found in origin l1BaseStore
 		if 0 < o.i {
-			o, err = s.origin.get(in)
+			s.observe(in.k, o.i)
+			// the entry seen when the transaction began, even if the key is written since then
+			o, err = fetch(s.origin, input[T]{i: o.i})
 		}
 	}
 	if err != nil {
@@ -222,7 +438,47 @@ func (s *l1TxnStore[T]) get(in input[T]) (o output[T], err error) {
 	return o, nil
 }
 
+// observe adds k to the read set with the origin entry i, unless k is already in it.
+// Entries of the transaction itself, with negative i, are not added.
+func (s *l1TxnStore[T]) observe(k []byte, i int64) {
+	if i < 0 {
+		return
+	}
+	if _, found := s.reads[string(k)]; found {
+		return
+	}
+	s.reads[string(k)] = i
+}
+
+// observeKey adds k to the read set before the transaction writes it.
+func (s *l1TxnStore[T]) observeKey(k []byte) {
+	var i int64
+	if item, found := s.l1BaseStore.btree.Get(&item{k: k}); found {
+		i = item.i
+	}
+	s.observe(k, i)
+}
+
+// validate returns ErrConflict if a key in the read set has been put or deleted
+// in the origin store since the transaction began.
+func (s *l1TxnStore[T]) validate() error {
+	s.origin.mu.RLock()
+	defer s.origin.mu.RUnlock()
+	for k, i := range s.reads {
+		var cur int64
+		if item, found := s.origin.btree.Get(&item{k: []byte(k)}); found {
+			cur = item.i
+		}
+		if cur != i {
+			return fmt.Errorf("%w: key '%s'", ErrConflict, k)
+		}
+	}
+	return nil
+}
+
 func (s *l1TxnStore[T]) delete(in input[T]) (o output[T], err error) {
+	s.origin.mu.RLock()
+	defer s.origin.mu.RUnlock()
 	switch {
 	case 0 < in.i:
 		k, found := s.origin.keys[in.i]
@@ -262,20 +518,23 @@ func (s *l1TxnStore[T]) delete(in input[T]) (o output[T], err error) {
 		o.val = s.l1BaseStore.vals[o.i]
 	}
 	// delete
-	o, _ = s.l1BaseStore.put(input[T]{k: o.key, v: o.val})
+	s.observeKey(o.key)
+	o, _ = s.write(input[T]{k: o.key, v: o.val})
 	s.dels[o.i] = true
 	o.deleted = true
 	return o, err
 }
 
-// return inserted uniq outputs ordered by insert-time asc
+// Commit merges the transaction into the origin store and returns the outputs merged.
 func (s *l1TxnStore[T]) Commit() ([]output[T], error) {
-	outputs := s.scan()
-	_, err := s.merge(outputs)
-	if err != nil {
-		return nil, err
-	}
+	outputs := s.pending()
+	s.merge(outputs)
+	return outputs, nil
+}
 
+// pending returns the last output of each key written in the transaction, in order of writes.
+func (s *l1TxnStore[T]) pending() []output[T] {
+	outputs := s.scan()
 	uniq := make(map[string][]byte, len(outputs))
 	results := make([]output[T], 0, len(outputs))
 	for _, o := range slices.Backward(outputs) {
@@ -289,56 +548,24 @@ func (s *l1TxnStore[T]) Commit() ([]output[T], error) {
 	slices.SortFunc(results, func(a, b output[T]) int {
 		return int(b.i) - int(a.i)
 	})
-	return results, nil
+	return results
 }
 
-func (s *l1TxnStore[T]) Rollback() error {
-	outputs := s.scan()
-	_, err := s.reverse(outputs)
-	return err
-}
-
-func (s *l1TxnStore[T]) merge(outputs []output[T]) (int64, error) {
+// merge applies the outputs to the origin store. Deletes of keys that are not
+// in the origin store, put and deleted in the transaction, are skipped.
+func (s *l1TxnStore[T]) merge(outputs []output[T]) {
 	s.l1BaseStore.mu.Lock()
 	defer s.l1BaseStore.mu.Unlock()
-
-	var success int64
-	for _, o := range outputs {
-		var err error
-		switch o.deleted {
-		case true:
-			_, err = s.origin.delete(input[T]{k: o.key})
-		case false:
-			_, err = s.origin.put(input[T]{k: o.key, v: o.val})
-		}
-		if err != nil && errors.Is(err, ErrKeyNotFound) {
-			err = fmt.Errorf("rollback: unexpected error: cannot merge [%v] : %w", o, err)
-			if _, err := s.reverse(outputs[:success]); err != nil {
-				panic(fmt.Errorf("cannot rollback: %w", err))
-			}
-			return 0, err
-		}
-		success++
-	}
-	return success, nil
-}
-
-func (s *l1TxnStore[T]) reverse(outputs []output[T]) (int64, error) {
-	var success int64
+	// snapshots read the origin concurrently
+	s.origin.mu.Lock()
+	defer s.origin.mu.Unlock()
 	for _, o := range outputs {
-		var err error
-		switch o.deleted {
-		case false:
-			_, err = s.origin.delete(input[T]{k: o.key})
-		case true:
-			_, err = s.origin.put(input[T]{k: o.key, v: o.val})
-		}
-		if err != nil && errors.Is(err, ErrKeyNotFound) {
-			return success, err
+		if o.deleted {
+			_, _ = s.origin.delete(input[T]{k: o.key})
+			continue
 		}
-		success++
+		_, _ = s.origin.put(input[T]{k: o.key, v: o.val, exp: o.exp})
 	}
-	return success, nil
 }
 
 // scan by i desc
@@ -354,6 +581,7 @@ func (s *l1TxnStore[T]) scan() []output[T] {
 			val:     s.l1BaseStore.vals[i],
 			i:       i,
 			deleted: s.dels[i],
+			exp:     s.l1BaseStore.exps[i],
 		}
 		outputs = append(outputs, o)
 		i--
@@ -361,6 +589,11 @@ func (s *l1TxnStore[T]) scan() []output[T] {
 	return outputs
 }
 
+// alive reports whether the output is neither deleted nor expired at now.
+func (o output[T]) alive(now int64) bool {
+	return !o.deleted && (o.exp == 0 || now < o.exp)
+}
+
 type (
 	iCounter     func(*int64)
 	storeOptions struct {
@@ -112,3 +112,30 @@ func TestL1TxnStore(t *testing.T) {
 	assert.Equal(t, "val", output.val)
 	assert.True(t, output.deleted)
 }
+
+func TestL1Snapshot(t *testing.T) {
+	s := newL1Store[string]()
+	_, err := s.put(input[string]{k: []byte("key-1"), v: "val-1", exp: 100})
+	assert.NoError(t, err)
+	_, err = s.put(input[string]{k: []byte("key-2"), v: "val-2"})
+	assert.NoError(t, err)
+	snap := s.snapshot()
+	// key-1 is read from the frozen entries
+	_, err = s.put(input[string]{k: []byte("key-1"), v: "newval-1"})
+	assert.NoError(t, err)
+
+	for _, k := range []string{"key-1", "key-2"} {
+		o, err := snap.get(input[string]{k: []byte(k)})
+		assert.NoError(t, err)
+		assert.Equal(t, "val-"+k[len(k)-1:], o.val)
+		h, err := snap.head(input[string]{k: []byte(k)})
+		assert.NoError(t, err)
+		assert.Equal(t, k, string(h.key))
+		assert.Equal(t, o.i, h.i)
+		assert.Equal(t, o.exp, h.exp)
+		assert.Empty(t, h.val)
+	}
+	snap.release()
+	_, err = snap.head(input[string]{k: []byte("key-2")})
+	assert.ErrorIs(t, err, ErrReleasedSnapshot)
+}
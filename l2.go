@@ -3,88 +3,306 @@ package hookdb
 import (
 	"bytes"
 	"context"
+	"errors"
 	"iter"
+	"slices"
 
 	"github.com/google/btree"
 )
 
-type l1Store[T any] interface {
-	BatchExec(cmd command[T], inputs ...input[T]) ([]output[T], []error)
-	Btree() *btree.BTreeG[*item]
-	Commit() (os []output[T], err error)
-	Exec(cmd command[T], in input[T]) (output[T], error)
-	Rollback() error
-	delete(in input[T]) (o output[T], err error)
-	get(in input[T]) (o output[T], err error)
-	put(in input[T]) (o output[T], err error)
-}
+type (
+	l1Store[T any] interface {
+		l1Reader[T]
+		BatchExec(cmd command[T], inputs ...input[T]) ([]output[T], []error)
+		Commit() (os []output[T], err error)
+		Exec(cmd command[T], in input[T]) (output[T], error)
+		delete(in input[T]) (o output[T], err error)
+		put(in input[T]) (o output[T], err error)
+	}
+	// l1Reader is the read side of l1Store, also implemented by l1Snapshot.
+	l1Reader[T any] interface {
+		Btree() *btree.BTreeG[*item]
+		get(in input[T]) (o output[T], err error)
+		head(in input[T]) (o output[T], err error)
+	}
+)
 
 type l2valueStore struct {
 	l1Store[[]byte]
 }
 
 func (s *l2valueStore) Query(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[output[[]byte], error] {
+	return queryRange(ctx, s.l1Store, k, prefixEnd(k), opts...)
+}
+
+// QueryRange iterates over the keys in [start, end) in ascending order, or descending with WithReverseQuery.
+// A nil start or end leaves the range unbounded on that side.
+func (s *l2valueStore) QueryRange(ctx context.Context, start, end []byte, opts ...QueryOption) iter.Seq2[output[[]byte], error] {
+	return queryRange(ctx, s.l1Store, start, end, opts...)
+}
+
+// snapshot returns a read-only view of the store at this point.
+// A transaction store is not shared between goroutines, so it is read as is.
+func (s *l2valueStore) snapshot() *l2valueSnapshot {
+	if l1, ok := s.l1Store.(*l1BaseStore[[]byte]); ok {
+		snap := l1.snapshot()
+		return &l2valueSnapshot{l1Reader: snap, release: snap.release}
+	}
+	return &l2valueSnapshot{l1Reader: s.l1Store, release: func() {}}
+}
+
+// l2valueSnapshot is a read-only view of l2valueStore. It must be released by release.
+type l2valueSnapshot struct {
+	l1Reader[[]byte]
+	release func()
+}
+
+func (s *l2valueSnapshot) Query(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[output[[]byte], error] {
+	return queryRange(ctx, s.l1Reader, k, prefixEnd(k), opts...)
+}
+
+func (s *l2valueSnapshot) QueryRange(ctx context.Context, start, end []byte, opts ...QueryOption) iter.Seq2[output[[]byte], error] {
+	return queryRange(ctx, s.l1Reader, start, end, opts...)
+}
+
+// queryRange stops and yields the error of ctx once ctx is done.
+func queryRange(ctx context.Context, s l1Reader[[]byte], start, end []byte, opts ...QueryOption) iter.Seq2[output[[]byte], error] {
 	var qo QueryOptions
 	for _, opt := range opts {
 		_ = opt(&qo)
 	}
-	var (
-		iterate func(btree.ItemIteratorG[*item])
-		skip    func(*item) bool
-	)
-	if qo.Reverse {
-		// increment last byte
-		l := len(k)
-		kk := make([]byte, l)
-		_ = copy(kk, k)
-		kk[l-1] += 1
-		iterate = func(iig btree.ItemIteratorG[*item]) {
-			s.Btree().DescendLessOrEqual(&item{k: kk}, iig)
-		}
-		skip = func(item *item) bool {
-			return bytes.Compare(k, item.k) == -1 && !bytes.HasPrefix(item.k, k)
+	// lo is inclusive unless loExclusive, hi is exclusive
+	lo, hi, loExclusive := start, end, false
+	if qo.StartAfter != nil {
+		switch {
+		case qo.Reverse && (hi == nil || bytes.Compare(qo.StartAfter, hi) == -1):
+			hi = qo.StartAfter
+		case !qo.Reverse && (lo == nil || bytes.Compare(lo, qo.StartAfter) <= 0):
+			lo, loExclusive = qo.StartAfter, true
 		}
-	} else {
-		iterate = func(iig btree.ItemIteratorG[*item]) {
-			s.Btree().AscendGreaterOrEqual(&item{k: k}, iig)
+	}
+	belowLo := func(k []byte) bool {
+		if lo == nil {
+			return false
 		}
-		skip = func(*item) bool { return false }
+		c := bytes.Compare(k, lo)
+		return c == -1 || (c == 0 && loExclusive)
+	}
+	aboveHi := func(k []byte) bool {
+		return hi != nil && bytes.Compare(k, hi) != -1
 	}
 	return func(yield func(output[[]byte], error) bool) {
-		iterate(func(item *item) bool {
-			if skip(item) {
-				return true
-			}
-			if !bytes.HasPrefix(item.k, k) {
+		fetch := s.get
+		if qo.KeysOnly {
+			fetch = s.head
+		}
+		visit := func(item *item) bool {
+			if err := ctx.Err(); err != nil {
+				yield(output[[]byte]{}, err)
 				return false
 			}
-			output, err := s.get(input[[]byte]{i: item.i})
-			if ok := yield(output, err); !ok {
+			output, err := fetch(input[[]byte]{i: item.i})
+			return yield(output, err)
+		}
+		if qo.Reverse {
+			iterate := func(item *item) bool {
+				if aboveHi(item.k) {
+					// DescendLessOrEqual starts at hi
+					return true
+				}
+				if belowLo(item.k) {
+					return false
+				}
+				return visit(item)
+			}
+			if hi == nil {
+				s.Btree().Descend(iterate)
+			} else {
+				s.Btree().DescendLessOrEqual(&item{k: hi}, iterate)
+			}
+			return
+		}
+		iterate := func(item *item) bool {
+			if belowLo(item.k) {
+				return true
+			}
+			if aboveHi(item.k) {
 				return false
 			}
-			return true
-		})
+			return visit(item)
+		}
+		if lo == nil {
+			s.Btree().Ascend(iterate)
+		} else {
+			s.Btree().AscendGreaterOrEqual(&item{k: lo}, iterate)
+		}
 	}
 }
 
-type l2hookStore struct {
-	l1Store[HookHandler]
+// prefixEnd returns the smallest key greater than every key with the prefix,
+// or nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; 0 <= i; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
 }
 
-func (s *l2hookStore) FoundPrefix(k []byte) iter.Seq2[output[HookHandler], error] {
-	return func(yield func(output[HookHandler], error) bool) {
-		s.Btree().DescendLessOrEqual(&item{k: k}, func(item *item) bool {
-			if item.k[0] != k[0] {
-				return false
+const (
+	anyHookTag byte = iota
+	prefixHookTag
+)
+
+type (
+	l2hookStore struct {
+		l1Store[hookSet]
+	}
+	// hookEntry is a hook called after writes, or a validator called before puts.
+	hookEntry struct {
+		id       HookID
+		fn       ContextHookHandler
+		validate Validator
+		// pattern is set for pattern hooks, which are indexed under the literal prefix of the pattern
+		pattern *Pattern
+	}
+	// hookSet holds the hooks of a prefix in order of registration.
+	hookSet struct {
+		// hooks are the hooks and validators of the prefix
+		hooks []hookEntry
+		// patterns are the pattern hooks, matched by trie
+		patterns []hookEntry
+		trie     *patternTrie
+		// owner is the store which may append to the set in place. Sets of other stores
+		// are copied before they are modified, since they can be shared with transactions.
+		// Readers sharing a set see only the entries below their own lengths.
+		owner *l2hookStore
+	}
+)
+
+// match returns the hooks of the set to call for k,
+// the hooks of the prefix followed by the pattern hooks matching k.
+func (set hookSet) match(k []byte) []hookEntry {
+	if len(set.patterns) == 0 {
+		return set.hooks
+	}
+	hooks := slices.Clip(set.hooks)
+	for _, n := range set.trie.match(k) {
+		// the trie can be ahead of the set when the owner appended to it
+		if n < len(set.patterns) {
+			hooks = append(hooks, set.patterns[n])
+		}
+	}
+	return hooks
+}
+
+// FoundPrefix iterates over the hooks of the prefixes of k from the longest,
+// and then the hooks of patterns without a literal prefix.
+func (s *l2hookStore) FoundPrefix(k []byte) iter.Seq2[output[hookSet], error] {
+	return func(yield func(output[hookSet], error) bool) {
+		hk := hookKey(k)
+		// one lookup for each length of the prefixes, and then the key of patterns without a prefix
+		for n := len(hk); 0 < n; n-- {
+			if n == 1 {
+				hk = hookKey(nil)
 			}
-			if !bytes.HasPrefix(k, item.k) {
-				return true
+			item, found := s.Btree().Get(&item{k: hk[:n]})
+			if !found {
+				continue
+			}
+			output, err := s.get(input[hookSet]{i: item.i})
+			if errors.Is(err, ErrKeyNotFound) {
+				// the hooks of a transaction's origin have been removed since it began
+				continue
+			}
+			if err == nil {
+				output.key = output.key[1:]
 			}
-			output, err := s.get(input[HookHandler]{i: item.i})
 			if ok := yield(output, err); !ok {
-				return false
+				return
 			}
-			return true
-		})
+		}
+	}
+}
+
+// Get returns the hooks of the prefix.
+func (s *l2hookStore) Get(prefix []byte) hookSet {
+	o, err := s.Exec(s.get, input[hookSet]{k: hookKey(prefix)})
+	if err != nil || o.deleted {
+		return hookSet{}
+	}
+	return o.val
+}
+
+// Append adds the hook to the hooks of the prefix.
+// The set is appended in place if the store owns it, so adding many hooks to a prefix
+// takes amortized constant time for each.
+func (s *l2hookStore) Append(prefix []byte, h hookEntry) error {
+	set := s.Get(prefix)
+	if set.owner != s {
+		set = newHookSet(s, slices.Clone(set.hooks), slices.Clone(set.patterns))
+	}
+	if h.pattern != nil {
+		for _, tokens := range h.pattern.alts {
+			set.trie.insert(tokens, len(set.patterns))
+		}
+		set.patterns = append(set.patterns, h)
+	} else {
+		set.hooks = append(set.hooks, h)
+	}
+	_, err := s.Exec(s.put, input[hookSet]{k: hookKey(prefix), v: set})
+	return err
+}
+
+// Remove removes the hooks with the ids from the hooks of the prefix.
+func (s *l2hookStore) Remove(prefix []byte, ids ...HookID) error {
+	set := s.Get(prefix)
+	removed := func(h hookEntry) bool {
+		return slices.Contains(ids, h.id)
+	}
+	hooks := slices.DeleteFunc(slices.Clone(set.hooks), removed)
+	patterns := slices.DeleteFunc(slices.Clone(set.patterns), removed)
+	if len(hooks)+len(patterns) == len(set.hooks)+len(set.patterns) {
+		return ErrKeyNotFound
+	}
+	var err error
+	if len(hooks)+len(patterns) == 0 {
+		_, err = s.Exec(s.delete, input[hookSet]{k: hookKey(prefix)})
+	} else {
+		_, err = s.Exec(s.put, input[hookSet]{k: hookKey(prefix), v: newHookSet(s, hooks, patterns)})
+	}
+	return err
+}
+
+// newHookSet returns a set owned by the store, with a new trie of the patterns.
+func newHookSet(owner *l2hookStore, hooks, patterns []hookEntry) hookSet {
+	trie := &patternTrie{}
+	for n, h := range patterns {
+		for _, tokens := range h.pattern.alts {
+			trie.insert(tokens, n)
+		}
+	}
+	return hookSet{hooks: hooks, patterns: patterns, trie: trie, owner: owner}
+}
+
+// RemoveAll removes all hooks of the prefix.
+func (s *l2hookStore) RemoveAll(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrEmptyEntry
+	}
+	_, err := s.Exec(s.delete, input[hookSet]{k: hookKey(prefix)})
+	return err
+}
+
+// hookKey returns the key of the hooks of the prefix in the store. Keys are tagged,
+// so that patterns without a literal prefix, which are checked against every key,
+// are kept under a key that cannot be a prefix.
+func hookKey(prefix []byte) []byte {
+	if len(prefix) == 0 {
+		return []byte{anyHookTag}
 	}
+	return append([]byte{prefixHookTag}, prefix...)
 }
@@ -2,6 +2,7 @@ package hookdb
 
 import (
 	"context"
+	"iter"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -51,13 +52,13 @@ func TestL2Query(t *testing.T) {
 }
 
 func TestL2HookStore(t *testing.T) {
-	l2 := l2hookStore{l1Store: newL1Store[HookHandler]()}
+	l2 := l2hookStore{l1Store: newL1Store[hookSet]()}
 	test := []string{
 		"a", "ab", "abc", "abcd", "abcde", "b", "bc",
 	}
 	called := make([]string, 0, len(test))
 	for _, tt := range test {
-		_, err := l2.Exec(l2.put, input[HookHandler]{k: []byte(tt), v: func(k, v []byte) (removeHook bool) {
+		err := l2.Append([]byte(tt), hookEntry{fn: func(_ *HookContext, e Event) (removeHook bool) {
 			called = append(called, tt)
 			return false
 		}})
@@ -66,8 +67,62 @@ func TestL2HookStore(t *testing.T) {
 
 	for output, err := range l2.FoundPrefix([]byte("abcd!")) {
 		assert.NoError(t, err)
-		output.val(nil, nil)
+		for _, h := range output.val.hooks {
+			h.fn(&HookContext{}, Event{})
+		}
 	}
 
 	assert.Equal(t, []string{"abcd", "abc", "ab", "a"}, called)
 }
+
+func TestL2QueryRange(t *testing.T) {
+	l2 := l2valueStore{l1Store: newL1Store[[]byte]()}
+	for _, tt := range []string{"a", "ab", "abc", "b", "bc", "c", "d"} {
+		_, err := l2.Exec(l2.put, input[[]byte]{k: []byte(tt), v: []byte(tt)})
+		assert.NoError(t, err)
+	}
+	keys := func(seq iter.Seq2[output[[]byte], error]) []string {
+		var got []string
+		for output, err := range seq {
+			assert.NoError(t, err)
+			got = append(got, string(output.key))
+		}
+		return got
+	}
+	test := []struct {
+		start, end string
+		opts       []QueryOption
+		want       []string
+	}{
+		{"ab", "bc", nil, []string{"ab", "abc", "b"}},
+		{"ab", "bc", []QueryOption{WithReverseQuery()}, []string{"b", "abc", "ab"}},
+		{"", "b", nil, []string{"a", "ab", "abc"}},
+		{"bc", "", nil, []string{"bc", "c", "d"}},
+		{"", "", []QueryOption{WithReverseQuery()}, []string{"d", "c", "bc", "b", "abc", "ab", "a"}},
+		{"a", "c", []QueryOption{WithStartAfter([]byte("abc"))}, []string{"b", "bc"}},
+		{"a", "c", []QueryOption{WithStartAfter([]byte("abc")), WithReverseQuery()}, []string{"ab", "a"}},
+		// start after outside of the range
+		{"b", "c", []QueryOption{WithStartAfter([]byte("a"))}, []string{"b", "bc"}},
+		{"b", "c", []QueryOption{WithStartAfter([]byte("d")), WithReverseQuery()}, []string{"bc", "b"}},
+		{"c", "b", nil, nil},
+	}
+	for _, tt := range test {
+		var start, end []byte
+		if tt.start != "" {
+			start = []byte(tt.start)
+		}
+		if tt.end != "" {
+			end = []byte(tt.end)
+		}
+		got := keys(l2.QueryRange(context.Background(), start, end, tt.opts...))
+		assert.Equal(t, tt.want, got, "[%s, %s)", tt.start, tt.end)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("abd"), prefixEnd([]byte("abc")))
+	assert.Equal(t, []byte{'a', 0x01}, prefixEnd([]byte{'a', 0x00}))
+	assert.Equal(t, []byte("b"), prefixEnd([]byte{'a', 0xff, 0xff}))
+	assert.Nil(t, prefixEnd([]byte{0xff}))
+	assert.Nil(t, prefixEnd(nil))
+}
@@ -1,31 +1,78 @@
 package hookdb
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"iter"
+	"maps"
+	"runtime/debug"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type l3Store struct {
-	l2values    *l2valueStore
-	l2hooks     *l2hookStore
-	mu          *sync.RWMutex
-	putCallback func(k, v []byte) error
+	l2values *l2valueStore
+	l2hooks  *l2hookStore
+	mu       *sync.RWMutex
+	callback func(e Event) error
+	// wal is nil unless the store is persistent
+	wal *wal
+	// closed is set by Close to reject writes, guarded by mu
+	closed bool
+	// compactionSize is the log size that triggers compaction
+	compactionSize int64
+	// hookSeq numbers hooks, shared with transactions
+	hookSeq *atomic.Uint64
+	// dispatcher runs async hooks, shared with transactions
+	dispatcher *dispatcher
+	// seq is the sequence number of the last write, guarded by mu
+	seq uint64
+	// changes keeps the latest writes for replayable subscriptions
+	changes *changeLog
+	// reaper removes expired keys, nil for transactions
+	reaper *reaper
+	// merges maps key prefixes to merge operators, shared with transactions
+	merges map[string]MergeOperator
+	// depth is the cascade depth of the writes being applied, guarded by mu
+	depth        int
+	maxHookDepth int
+	// maxUpdateRetries is the number of retries of HookDB.Update on conflicts
+	maxUpdateRetries int
+	// onHookError is called with panics recovered from hooks, shared with transactions
+	onHookError func(err *HookError)
 }
 
-func newL3Store() *l3Store {
+func newL3Store(o *Options) *l3Store {
 	s := &l3Store{
 		l2values: &l2valueStore{
 			l1Store: newL1Store[[]byte](),
 		},
 		l2hooks: &l2hookStore{
-			l1Store: newL1Store[HookHandler](),
+			l1Store: newL1Store[hookSet](),
 		},
-		mu: new(sync.RWMutex),
+		mu:               new(sync.RWMutex),
+		hookSeq:          new(atomic.Uint64),
+		changes:          newChangeLog(o.getChangeLogSize()),
+		compactionSize:   o.getCompactionSize(),
+		reaper:           &reaper{interval: o.getExpiryInterval()},
+		merges:           maps.Clone(o.MergeOperators),
+		maxHookDepth:     o.getMaxHookDepth(),
+		onHookError:      o.getOnHookError(),
+		maxUpdateRetries: o.getMaxUpdateRetries(),
 	}
-	s.putCallback = func(k, v []byte) error {
-		return hook(s.l2hooks, k, v)
+	s.dispatcher = newDispatcher(o.getHookWorkers(), o.getHookQueueSize(), s.onHookError)
+	s.callback = func(e Event) error {
+		hc := &HookContext{depth: s.depth}
+		if err := hook(s.l2hooks, s.record(e), hc, s.onHookError); err != nil {
+			return err
+		}
+		return s.cascade(hc)
 	}
 	return s
 }
@@ -33,6 +80,7 @@ func newL3Store() *l3Store {
 func (s *l3Store) Transaction() *l3TxnStore {
 	return &l3TxnStore{
 		l3Store: s.withL1Txn(),
+		origin:  s,
 		parent:  s.mu,
 		closed:  false,
 	}
@@ -42,6 +90,7 @@ func (s *l3Store) TransactionWithLock() *l3TxnStore {
 	s.mu.Lock()
 	return &l3TxnStore{
 		l3Store: s.withL1Txn(),
+		origin:  s,
 		parent:  s.mu,
 		inLock:  true,
 		closed:  false,
@@ -54,46 +103,319 @@ func (s *l3Store) withL1Txn() *l3Store {
 			l1Store: newL1TxnStore(s.l2values.l1Store.(*l1BaseStore[[]byte])),
 		},
 		l2hooks: &l2hookStore{
-			l1Store: newL1TxnStore(s.l2hooks.l1Store.(*l1BaseStore[HookHandler])),
+			l1Store: newL1TxnStore(s.l2hooks.l1Store.(*l1BaseStore[hookSet])),
 		},
-		putCallback: func(k, v []byte) error { return nil },
-		mu:          new(sync.RWMutex),
+		// hooks are called on commit
+		callback: func(e Event) error { return nil },
+		mu:       new(sync.RWMutex),
+		hookSeq:  s.hookSeq,
+		changes:  newChangeLog(0),
+		merges:   s.merges,
+		// async hooks appended in a transaction are run by the origin
+		dispatcher:  s.dispatcher,
+		onHookError: s.onHookError,
 	}
 	return l3
 }
 
 func (s *l3Store) Put(k, v []byte) error {
-	s.mu.Lock()
+	return s.PutContext(context.Background(), k, v)
+}
+
+func (s *l3Store) PutContext(ctx context.Context, k, v []byte) error {
+	if err := s.lockWrite(ctx); err != nil {
+		return err
+	}
 	defer s.mu.Unlock()
-	_, err := s.l2values.Exec(s.l2values.put, input[[]byte]{k: k, v: v})
+	return s.put(k, v, 0)
+}
+
+func (s *l3Store) PutWithTTL(k, v []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive: %s", ttl)
+	}
+	if err := s.lockWrite(context.Background()); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	return s.put(k, v, time.Now().Add(ttl).UnixNano())
+}
+
+// put writes v to k. The key expires at exp in unix nano unless exp is 0.
+// The caller must hold the write lock.
+func (s *l3Store) put(k, v []byte, exp int64) error {
+	if len(k) == 0 {
+		return ErrEmptyEntry
+	}
+	if err := validate(s.l2hooks, k, v); err != nil {
+		return err
+	}
+	if err := s.log(newPutEntry(k, v, exp)); err != nil {
+		return err
+	}
+	var prev []byte
+	if o, err := s.l2values.Exec(s.l2values.get, input[[]byte]{k: k}); err == nil && o.alive(time.Now().UnixNano()) {
+		prev = o.val
+	}
+	_, err := s.l2values.Exec(s.l2values.put, input[[]byte]{k: k, v: v, exp: exp})
 	if err != nil {
 		return err
 	}
-	return s.putCallback(k, v)
+	if exp != 0 {
+		s.startReaper()
+	}
+	err = s.callback(Event{Op: OpPut, Key: k, Value: v, Prev: prev})
+	// compaction writes the sequence number, so it follows the event
+	s.compact()
+	return err
 }
 
 func (s *l3Store) Get(k []byte) ([]byte, error) {
-	s.mu.RLock()
+	return s.GetContext(context.Background(), k)
+}
+
+func (s *l3Store) GetContext(ctx context.Context, k []byte) ([]byte, error) {
+	if err := lockContext(ctx, s.mu.TryRLock, s.mu.RLock, s.mu.RUnlock); err != nil {
+		return nil, err
+	}
 	defer s.mu.RUnlock()
+	return s.get(k)
+}
+
+// get returns the value of k if it is alive. The caller must hold the lock.
+func (s *l3Store) get(k []byte) ([]byte, error) {
 	o, err := s.l2values.Exec(s.l2values.get, input[[]byte]{k: k})
 	if err != nil {
 		return nil, err
 	}
+	if !o.alive(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
 	return o.val, nil
 }
 
 func (s *l3Store) Delete(k []byte) error {
-	s.mu.Lock()
+	return s.DeleteContext(context.Background(), k)
+}
+
+func (s *l3Store) DeleteContext(ctx context.Context, k []byte) error {
+	if err := s.lockWrite(ctx); err != nil {
+		return err
+	}
 	defer s.mu.Unlock()
-	_, err := s.l2values.Exec(s.l2values.delete, input[[]byte]{k: k})
+	return s.delete(k)
+}
+
+// delete deletes k if it is alive. The caller must hold the write lock.
+func (s *l3Store) delete(k []byte) error {
+	o, err := s.l2values.Exec(s.l2values.get, input[[]byte]{k: k})
+	if err != nil {
+		return err
+	}
+	if !o.alive(time.Now().UnixNano()) {
+		return ErrKeyNotFound
+	}
+	if err := s.log(walEntry{op: walDelete, k: k}); err != nil {
+		return err
+	}
+	o, err = s.l2values.Exec(s.l2values.delete, input[[]byte]{k: k})
+	if err != nil {
+		return err
+	}
+	err = s.callback(Event{Op: OpDelete, Key: k, Prev: o.val})
+	s.compact()
 	return err
 }
 
+// CompareAndSwap puts new to k if the current value of k is old.
+func (s *l3Store) CompareAndSwap(k, old, new []byte) (bool, error) {
+	if err := s.lockWrite(context.Background()); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	v, err := s.get(k)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil || !bytes.Equal(v, old) {
+		return false, err
+	}
+	return true, s.put(k, new, 0)
+}
+
+// PutIfAbsent puts v to k if k does not exist.
+func (s *l3Store) PutIfAbsent(k, v []byte) (bool, error) {
+	if err := s.lockWrite(context.Background()); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	_, err := s.get(k)
+	if !errors.Is(err, ErrKeyNotFound) {
+		return false, err
+	}
+	return true, s.put(k, v, 0)
+}
+
+// DeleteIfEquals deletes k if the current value of k is v.
+func (s *l3Store) DeleteIfEquals(k, v []byte) (bool, error) {
+	if err := s.lockWrite(context.Background()); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	cur, err := s.get(k)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil || !bytes.Equal(cur, v) {
+		return false, err
+	}
+	return true, s.delete(k)
+}
+
+// lockContext acquires a lock by lock, or returns the error of ctx if ctx is done first.
+// A lock acquired after ctx is done is released by unlock.
+func lockContext(ctx context.Context, tryLock func() bool, lock, unlock func()) error {
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// Query iterates over a snapshot taken when the iteration starts,
+// so that writes during the iteration neither race with it nor appear in it.
 func (s *l3Store) Query(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		snap := s.snapshot()
+		defer snap.Release()
+		for v, err := range snap.Query(ctx, k, opts...) {
+			if ok := yield(v, err); !ok {
+				return
+			}
+		}
+	}
+}
+
+func (s *l3Store) QueryRange(ctx context.Context, start, end []byte, opts ...QueryOption) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		snap := s.snapshot()
+		defer snap.Release()
+		for v, err := range snap.QueryRange(ctx, start, end, opts...) {
+			if ok := yield(v, err); !ok {
+				return
+			}
+		}
+	}
+}
+
+func (s *l3Store) QueryKV(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[KV, error] {
+	return func(yield func(KV, error) bool) {
+		snap := s.snapshot()
+		defer snap.Release()
+		for kv, err := range snap.QueryKV(ctx, k, opts...) {
+			if ok := yield(kv, err); !ok {
+				return
+			}
+		}
+	}
+}
+
+func (s *l3Store) snapshot() *l3Snapshot {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	return &l3Snapshot{
+		l2values: s.l2values.snapshot(),
+		now:      time.Now().UnixNano(),
+	}
+}
+
+// l3Snapshot is a read-only view of l3Store.
+// Keys are alive or expired as of now, the time the snapshot is taken.
+type l3Snapshot struct {
+	l2values *l2valueSnapshot
+	now      int64
+}
+
+func (s *l3Snapshot) Get(k []byte) ([]byte, error) {
+	o, err := s.l2values.get(input[[]byte]{k: k})
+	if err != nil {
+		return nil, err
+	}
+	if !o.alive(s.now) {
+		return nil, ErrKeyNotFound
+	}
+	return o.val, nil
+}
+
+func (s *l3Snapshot) Query(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[[]byte, error] {
+	return values(live(s.l2values.Query(ctx, k, opts...), s.now, opts))
+}
+
+func (s *l3Snapshot) QueryRange(ctx context.Context, start, end []byte, opts ...QueryOption) iter.Seq2[[]byte, error] {
+	return values(live(s.l2values.QueryRange(ctx, start, end, opts...), s.now, opts))
+}
+
+func (s *l3Snapshot) QueryKV(ctx context.Context, k []byte, opts ...QueryOption) iter.Seq2[KV, error] {
+	outputs := live(s.l2values.Query(ctx, k, opts...), s.now, opts)
+	return func(yield func(KV, error) bool) {
+		for output, err := range outputs {
+			if ok := yield(KV{Key: output.key, Value: output.val}, err); !ok {
+				return
+			}
+		}
+	}
+}
+
+func (s *l3Snapshot) Release() {
+	s.l2values.release()
+}
+
+// live yields the outputs that are neither deleted nor expired at now, up to the limit of opts.
+func live(outputs iter.Seq2[output[[]byte], error], now int64, opts []QueryOption) iter.Seq2[output[[]byte], error] {
+	var qo QueryOptions
+	for _, opt := range opts {
+		_ = opt(&qo)
+	}
+	return func(yield func(output[[]byte], error) bool) {
+		var n int
+		for output, err := range outputs {
+			if err == nil && !output.alive(now) {
+				continue
+			}
+			if ok := yield(output, err); !ok {
+				return
+			}
+			n++
+			if 0 < qo.Limit && qo.Limit <= n {
+				return
+			}
+		}
+	}
+}
+
+func values(outputs iter.Seq2[output[[]byte], error]) iter.Seq2[[]byte, error] {
 	return func(yield func([]byte, error) bool) {
-		for output, err := range s.l2values.Query(ctx, k, opts...) {
+		for output, err := range outputs {
 			if ok := yield(output.val, err); !ok {
 				return
 			}
@@ -101,26 +423,276 @@ func (s *l3Store) Query(ctx context.Context, k []byte, opts ...QueryOption) iter
 	}
 }
 
-func (s *l3Store) AppendHook(prefix []byte, fn HookHandler) error {
+func (s *l3Store) AppendHook(prefix []byte, fn HookHandler) (HookID, error) {
+	return s.AppendEventHook(prefix, func(e Event) bool {
+		if e.Op != OpPut {
+			return false
+		}
+		return fn(e.Key, e.Value)
+	})
+}
+
+func (s *l3Store) AppendEventHook(prefix []byte, fn EventHandler) (HookID, error) {
+	return s.AppendContextHook(prefix, func(_ *HookContext, e Event) bool {
+		return fn(e)
+	})
+}
+
+func (s *l3Store) AppendContextHook(prefix []byte, fn ContextHookHandler) (HookID, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	_, err := s.l2hooks.Exec(s.l2hooks.put, input[HookHandler]{k: prefix, v: fn})
-	return err
+	return s.appendHook(prefix, fn)
+}
+
+// AppendReplayHook passes the past events selected by r to replay and then appends fn,
+// both under the write lock, so that fn receives the events right after them
+// without gaps or duplicates.
+func (s *l3Store) AppendReplayHook(prefix []byte, r replayRange, replay func([]Event), fn EventHandler) (HookID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events, err := s.history(prefix, r)
+	if err != nil {
+		return HookID{}, err
+	}
+	id, err := s.appendHook(prefix, func(_ *HookContext, e Event) bool {
+		return fn(e)
+	})
+	if err != nil {
+		return HookID{}, err
+	}
+	replay(events)
+	return id, nil
+}
+
+type replayRange struct {
+	// from is the first sequence number of changes to replay
+	from uint64
+	// existing replays current keys instead of changes
+	existing bool
+}
+
+func (s *l3Store) history(prefix []byte, r replayRange) ([]Event, error) {
+	var events []Event
+	switch {
+	case r.existing:
+		now := time.Now().UnixNano()
+		for o, err := range s.l2values.Query(context.Background(), prefix) {
+			if err != nil {
+				return nil, err
+			}
+			if !o.alive(now) {
+				continue
+			}
+			events = append(events, Event{Op: OpPut, Key: o.key, Value: o.val, Seq: s.seq})
+		}
+	case r.from != 0:
+		changes, err := s.changes.since(r.from, s.seq)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range changes {
+			if bytes.HasPrefix(e.Key, prefix) {
+				events = append(events, e)
+			}
+		}
+	}
+	return events, nil
+}
+
+func (s *l3Store) AppendValidator(prefix []byte, fn Validator) (HookID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appendEntry(prefix, hookEntry{validate: fn})
+}
+
+func (s *l3Store) appendHook(prefix []byte, fn ContextHookHandler) (HookID, error) {
+	return s.appendEntry(prefix, hookEntry{fn: fn})
+}
+
+func (s *l3Store) appendEntry(prefix []byte, h hookEntry) (HookID, error) {
+	// only patterns can match any key
+	if len(prefix) == 0 && h.pattern == nil {
+		return HookID{}, ErrEmptyEntry
+	}
+	h.id = HookID{prefix: string(prefix), n: s.hookSeq.Add(1)}
+	if err := s.l2hooks.Append(prefix, h); err != nil {
+		return HookID{}, err
+	}
+	return h.id, nil
 }
 
 func (s *l3Store) RemoveHook(prefix []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	_, err := s.l2hooks.Exec(s.l2hooks.delete, input[HookHandler]{k: prefix})
-	return err
+	return s.l2hooks.RemoveAll(prefix)
+}
+
+func (s *l3Store) RemoveHookByID(id HookID) error {
+	if id.n == 0 {
+		return ErrKeyNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.l2hooks.Remove([]byte(id.prefix), id)
+}
+
+// cascade applies the writes queued by hooks as a batch.
+// The caller must hold the write lock.
+func (s *l3Store) cascade(hc *HookContext) error {
+	if hc.batch.Len() == 0 {
+		return nil
+	}
+	if s.maxHookDepth <= s.depth {
+		return fmt.Errorf("%w: %d", ErrHookDepthExceeded, s.maxHookDepth)
+	}
+	s.depth++
+	defer func() { s.depth-- }()
+	return s.write(&hc.batch)
+}
+
+// record numbers the write and keeps it in the change log. The caller must hold the write lock.
+func (s *l3Store) record(e Event) Event {
+	s.seq++
+	e.Seq = s.seq
+	s.changes.append(e)
+	return e
+}
+
+// log appends entries to the write-ahead log as one atomic record.
+// It does nothing if the store is not persistent.
+func (s *l3Store) log(entries ...walEntry) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.append(entries...)
+}
+
+// replay applies entries read from the write-ahead log without calling hooks.
+// Every write entry has had an event, so the sequence number is counted up by each of them,
+// and set by the walSeq entry ending a snapshot.
+func (s *l3Store) replay(entries []walEntry) error {
+	for _, e := range entries {
+		var err error
+		if e.op != walSeq {
+			s.seq++
+		}
+		switch e.op {
+		case walSeq:
+			s.seq, err = e.seqValue()
+		case walPut:
+			_, err = s.l2values.put(input[[]byte]{k: e.k, v: e.v})
+		case walPutTTL:
+			var (
+				v   []byte
+				exp int64
+			)
+			if v, exp, err = e.ttlValue(); err == nil {
+				_, err = s.l2values.put(input[[]byte]{k: e.k, v: v, exp: exp})
+			}
+		case walDelete:
+			_, err = s.l2values.delete(input[[]byte]{k: e.k})
+			if errors.Is(err, ErrKeyNotFound) {
+				err = nil
+			}
+		default:
+			err = fmt.Errorf("wal: unknown op '%d'", e.op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotBatchSize is the number of entries in each record of a snapshot.
+const snapshotBatchSize = 256
+
+func (s *l3Store) Snapshot(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.writeSnapshot(w)
+}
+
+// writeSnapshot writes all live keys to w as write-ahead log records,
+// followed by the sequence number of the last write.
+func (s *l3Store) writeSnapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	entries := make([]walEntry, 0, snapshotBatchSize)
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		_, err := bw.Write(encodeWALRecord(entries))
+		entries = entries[:0]
+		return err
+	}
+	now := time.Now().UnixNano()
+	for o, err := range s.l2values.Query(context.Background(), nil) {
+		if err != nil {
+			return err
+		}
+		if !o.alive(now) {
+			continue
+		}
+		entries = append(entries, newPutEntry(o.key, o.val, o.exp))
+		if len(entries) == snapshotBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	entries = append(entries, newSeqEntry(s.seq))
+	if err := flush(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// compact rewrites the write-ahead log from a snapshot once it has grown beyond compactionSize.
+// A failed compaction leaves the log as is, and its error is returned by Sync,
+// since the write triggering it has already been applied.
+func (s *l3Store) compact() {
+	if s.wal == nil || !s.wal.needsCompaction(s.compactionSize) {
+		return
+	}
+	_ = s.wal.compact(s.writeSnapshot)
+}
+
+func (s *l3Store) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Sync()
+}
+
+func (s *l3Store) Close() error {
+	// the reaper takes the lock, and async hooks may use the database
+	s.reaper.close()
+	s.dispatcher.close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.close()
 }
 
 type l3TxnStore struct {
 	*l3Store
 
+	origin *l3Store
 	inLock bool
 	parent *sync.RWMutex
 	closed bool
+	// savepoints are the valid savepoints in order of creation
+	savepoints []Savepoint
+	spSeq      uint64
 }
 
 func (s *l3TxnStore) Commit() error {
@@ -128,34 +700,118 @@ func (s *l3TxnStore) Commit() error {
 		return ErrClosedTransaction
 	}
 	if !s.inLock {
+		if err := s.origin.dispatcher.throttle(context.Background()); err != nil {
+			return err
+		}
 		s.parent.Lock()
 	}
 	defer func() {
 		s.closed = true
 		s.parent.Unlock()
 	}()
-	outputs, err := s.l2values.Commit()
-	if err != nil {
+	if err := s.l2values.l1Store.(*l1TxnStore[[]byte]).validate(); err != nil {
+		return err
+	}
+	if err := s.validate(); err != nil {
+		return err
+	}
+	prevs := s.prevs()
+	txn := s.l2values.l1Store.(*l1TxnStore[[]byte])
+	// keys put and deleted in the transaction, or deleted after they expired, are left
+	// as they are, so that every logged entry has an event
+	outputs := slices.DeleteFunc(txn.pending(), func(o output[[]byte]) bool {
+		_, found := prevs[string(o.key)]
+		return o.deleted && !found
+	})
+	entries := make([]walEntry, 0, len(outputs))
+	for _, o := range outputs {
+		e := newPutEntry(o.key, o.val, o.exp)
+		if o.deleted {
+			e = walEntry{op: walDelete, k: o.key}
+		}
+		entries = append(entries, e)
+	}
+	// all outputs are logged as a single record before they are applied,
+	// so a commit failing to log leaves the database as it was
+	if err := s.origin.log(entries...); err != nil {
 		return err
 	}
+	txn.merge(outputs)
 	for _, o := range outputs {
+		if o.exp != 0 {
+			s.origin.startReaper()
+			break
+		}
+	}
+	// all events are recorded and passed to hooks before the writes of hooks are applied,
+	// so that they get consecutive sequence numbers and are delivered in order
+	events := make([]Event, 0, len(outputs))
+	for _, o := range outputs {
+		prev := prevs[string(o.key)]
+		e := Event{Op: OpPut, Key: o.key, Value: o.val, Prev: prev}
+		if o.deleted {
+			e = Event{Op: OpDelete, Key: o.key, Prev: prev}
+		}
+		events = append(events, s.origin.record(e))
+	}
+	// the transaction is committed, so errors of hooks are reported to onHookError
+	hcs := make([]*HookContext, len(events))
+	for n, e := range events {
+		hcs[n] = &HookContext{}
+		if err := hook(s.l2hooks, e, hcs[n], s.onHookError); err != nil {
+			s.onHookError(&HookError{Key: e.Key, Value: err})
+		}
+	}
+	for n, e := range events {
+		if err := s.origin.cascade(hcs[n]); err != nil {
+			s.onHookError(&HookError{Key: e.Key, Value: err})
+		}
+	}
+	s.origin.compact()
+	_, _ = s.l2hooks.Commit()
+	return nil
+}
+
+// validate calls the validators with the last value put to each key in the transaction.
+func (s *l3TxnStore) validate() error {
+	last := make(map[string]output[[]byte])
+	keys := make([]string, 0)
+	for _, o := range s.l2values.l1Store.(*l1TxnStore[[]byte]).scan() {
+		if _, found := last[string(o.key)]; !found {
+			keys = append(keys, string(o.key))
+		}
+		last[string(o.key)] = o
+	}
+	for _, k := range keys {
+		o := last[k]
 		if o.deleted {
 			continue
 		}
-		err := hook(s.l2hooks, o.key, o.val)
-		if err != nil {
-			err = fmt.Errorf("%w: %w", err, s.l2values.Rollback())
+		if err := validate(s.l2hooks, o.key, o.val); err != nil {
 			return err
 		}
 	}
-	_, err = s.l2hooks.Commit()
-	if err != nil {
-		err = fmt.Errorf("%w: %w", err, s.l2values.Rollback())
-		return err
-	}
 	return nil
 }
 
+// prevs returns the values in the origin store of the keys written in the transaction.
+// Keys that do not exist in the origin store are not included.
+func (s *l3TxnStore) prevs() map[string][]byte {
+	txn := s.l2values.l1Store.(*l1TxnStore[[]byte])
+	prevs := make(map[string][]byte)
+	for _, o := range txn.scan() {
+		if _, found := prevs[string(o.key)]; found {
+			continue
+		}
+		prev, err := txn.origin.get(input[[]byte]{k: o.key})
+		if err != nil || !prev.alive(time.Now().UnixNano()) {
+			continue
+		}
+		prevs[string(o.key)] = prev.val
+	}
+	return prevs
+}
+
 func (s *l3TxnStore) Rollback() error {
 	if s.closed {
 		return ErrClosedTransaction
@@ -170,7 +826,100 @@ func (s *l3TxnStore) Rollback() error {
 	return nil
 }
 
-func hook(l2 *l2hookStore, k, v []byte) error {
+func (s *l3TxnStore) Savepoint() Savepoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spSeq++
+	sp := Savepoint{
+		n:      s.spSeq,
+		values: s.l2values.l1Store.(*l1TxnStore[[]byte]).nextI,
+		hooks:  s.l2hooks.l1Store.(*l1TxnStore[hookSet]).nextI,
+	}
+	s.savepoints = append(s.savepoints, sp)
+	return sp
+}
+
+// RollbackTo discards the writes after sp and the savepoints taken after sp.
+// sp stays valid.
+func (s *l3TxnStore) RollbackTo(sp Savepoint) error {
+	if s.closed {
+		return ErrClosedTransaction
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := slices.Index(s.savepoints, sp)
+	if n < 0 {
+		return ErrInvalidSavepoint
+	}
+	s.savepoints = s.savepoints[:n+1]
+	s.l2values.l1Store.(*l1TxnStore[[]byte]).truncate(sp.values)
+	s.l2hooks.l1Store.(*l1TxnStore[hookSet]).truncate(sp.hooks)
+	return nil
+}
+
+// release discards sp and the savepoints taken after sp, keeping the writes.
+func (s *l3TxnStore) release(sp Savepoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := slices.Index(s.savepoints, sp)
+	if n < 0 {
+		return ErrInvalidSavepoint
+	}
+	s.savepoints = s.savepoints[:n]
+	return nil
+}
+
+func (s *l3TxnStore) Nested() *l3NestedTxnStore {
+	return &l3NestedTxnStore{
+		l3TxnStore: s,
+		sp:         s.Savepoint(),
+	}
+}
+
+// l3NestedTxnStore is a transaction nested in a l3TxnStore.
+// It writes to the parent transaction directly, so commit only releases the savepoint
+// taken when it began, and rollback rolls back the parent transaction to it.
+type l3NestedTxnStore struct {
+	*l3TxnStore
+
+	sp     Savepoint
+	closed bool
+}
+
+func (s *l3NestedTxnStore) Commit() error {
+	if s.closed {
+		return ErrClosedTransaction
+	}
+	s.closed = true
+	return s.release(s.sp)
+}
+
+func (s *l3NestedTxnStore) Rollback() error {
+	if s.closed {
+		return ErrClosedTransaction
+	}
+	s.closed = true
+	if err := s.RollbackTo(s.sp); err != nil {
+		return err
+	}
+	return s.release(s.sp)
+}
+
+// call calls fn with hc and e, and recovers a panic of fn as a HookError.
+// The writes queued by fn before the panic are discarded.
+func call(fn ContextHookHandler, hc *HookContext, e Event, prefix []byte) (removeHook bool, herr *HookError) {
+	n := hc.batch.Len()
+	defer func() {
+		if r := recover(); r != nil {
+			hc.batch.entries = hc.batch.entries[:n]
+			herr = &HookError{Prefix: prefix, Key: e.Key, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn(hc, e), nil
+}
+
+// validate calls the validators of k with v, and returns the first error wrapped in ErrInvalidValue.
+func validate(l2 *l2hookStore, k, v []byte) error {
 	for output, err := range l2.FoundPrefix(k) {
 		if err != nil {
 			return err
@@ -178,11 +927,46 @@ func hook(l2 *l2hookStore, k, v []byte) error {
 		if output.deleted {
 			continue
 		}
-		if output.val(k, v) {
-			_, err := l2.Exec(l2.delete, input[HookHandler]{i: output.i})
-			if err != nil {
-				return err
+		for _, h := range output.val.hooks {
+			if h.validate == nil {
+				continue
+			}
+			if err := h.validate(k, v); err != nil {
+				return fmt.Errorf("%w: '%s': %w", ErrInvalidValue, k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// hook calls the hooks of the prefixes of e.Key. Panics of hooks are recovered and passed to onError.
+func hook(l2 *l2hookStore, e Event, hc *HookContext, onError func(err *HookError)) error {
+	// hooks are removed after the iteration not to modify the btree while iterating it
+	var removes []HookID
+	for output, err := range l2.FoundPrefix(e.Key) {
+		if err != nil {
+			return err
+		}
+		if output.deleted {
+			continue
+		}
+		for _, h := range output.val.match(e.Key) {
+			if h.fn == nil {
+				continue
+			}
+			remove, herr := call(h.fn, hc, e, output.key)
+			if herr != nil {
+				onError(herr)
 			}
+			if remove {
+				removes = append(removes, h.id)
+			}
+		}
+	}
+	for _, id := range removes {
+		err := l2.Remove([]byte(id.prefix), id)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
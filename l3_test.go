@@ -1,9 +1,19 @@
 package hookdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTransaction(t *testing.T) {
@@ -15,7 +25,7 @@ func TestTransaction(t *testing.T) {
 		assert.NoError(t, err)
 
 		calledKeys := []string{}
-		err = db.AppendHook([]byte("abc"), func(k, v []byte) (removeHook bool) {
+		_, err = db.AppendHook([]byte("abc"), func(k, v []byte) (removeHook bool) {
 			calledKeys = append(calledKeys, string(k))
 			return false
 		})
@@ -116,3 +126,999 @@ func TestTransaction(t *testing.T) {
 		assert.Equal(t, "newval-2", string(val))
 	})
 }
+
+func TestTransactionConflict(t *testing.T) {
+	test := []struct {
+		name     string
+		txn      func(txn *Transaction) error
+		other    func(db *HookDB) error
+		conflict bool
+	}{
+		{
+			name:     "read and overwritten",
+			txn:      func(txn *Transaction) error { _, err := txn.Get([]byte("key-1")); return err },
+			other:    func(db *HookDB) error { return db.Put([]byte("key-1"), []byte("other")) },
+			conflict: true,
+		},
+		{
+			name:     "read and deleted",
+			txn:      func(txn *Transaction) error { _, err := txn.Get([]byte("key-1")); return err },
+			other:    func(db *HookDB) error { return db.Delete([]byte("key-1")) },
+			conflict: true,
+		},
+		{
+			name: "read missing and put",
+			txn: func(txn *Transaction) error {
+				_, err := txn.Get([]byte("key-9"))
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+				return nil
+			},
+			other:    func(db *HookDB) error { return db.Put([]byte("key-9"), []byte("other")) },
+			conflict: true,
+		},
+		{
+			name: "queried and overwritten",
+			txn: func(txn *Transaction) error {
+				for _, err := range txn.Query(context.Background(), []byte("key")) {
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			other:    func(db *HookDB) error { return db.Put([]byte("key-2"), []byte("other")) },
+			conflict: true,
+		},
+		{
+			name:     "written and overwritten",
+			txn:      func(txn *Transaction) error { return txn.Put([]byte("key-1"), []byte("txn")) },
+			other:    func(db *HookDB) error { return db.Put([]byte("key-1"), []byte("other")) },
+			conflict: true,
+		},
+		{
+			name:     "deleted and overwritten",
+			txn:      func(txn *Transaction) error { return txn.Delete([]byte("key-1")) },
+			other:    func(db *HookDB) error { return db.Put([]byte("key-1"), []byte("other")) },
+			conflict: true,
+		},
+		{
+			name:  "other key",
+			txn:   func(txn *Transaction) error { return txn.Put([]byte("key-1"), []byte("txn")) },
+			other: func(db *HookDB) error { return db.Put([]byte("key-2"), []byte("other")) },
+		},
+	}
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			db := New()
+			assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+			assert.NoError(t, db.Put([]byte("key-2"), []byte("val-2")))
+			var events int
+			_, err := db.AppendEventHook([]byte("key"), func(e Event) bool {
+				events++
+				return false
+			})
+			assert.NoError(t, err)
+
+			txn := db.Transaction()
+			assert.NoError(t, tt.txn(txn))
+			assert.NoError(t, tt.other(db))
+			err = txn.Commit()
+			if !tt.conflict {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrConflict)
+			assert.ErrorIs(t, txn.Commit(), ErrClosedTransaction)
+			// only the other write is applied
+			assert.Equal(t, 1, events)
+			v, err := db.Get([]byte("key-1"))
+			if err == nil {
+				assert.NotEqual(t, "txn", string(v))
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	t.Parallel()
+	db := New()
+	assert.NoError(t, db.Put([]byte("counter"), []byte("0")))
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.Update(func(txn *Transaction) error {
+				v, err := txn.Get([]byte("counter"))
+				if err != nil {
+					return err
+				}
+				n, err := strconv.Atoi(string(v))
+				if err != nil {
+					return err
+				}
+				return txn.Put([]byte("counter"), []byte(strconv.Itoa(n+1)))
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	v, err := db.Get([]byte("counter"))
+	assert.NoError(t, err)
+	assert.Equal(t, "10", string(v))
+
+	errFailed := errors.New("failed")
+	err = db.Update(func(txn *Transaction) error {
+		assert.NoError(t, txn.Put([]byte("counter"), []byte("100")))
+		return errFailed
+	})
+	assert.ErrorIs(t, err, errFailed)
+	v, err = db.Get([]byte("counter"))
+	assert.NoError(t, err)
+	assert.Equal(t, "10", string(v))
+
+	assert.PanicsWithValue(t, "failed", func() {
+		_ = db.Update(func(txn *Transaction) error {
+			assert.NoError(t, txn.Put([]byte("counter"), []byte("100")))
+			panic("failed")
+		})
+	})
+	v, err = db.Get([]byte("counter"))
+	assert.NoError(t, err)
+	assert.Equal(t, "10", string(v))
+	// the lock is not leaked
+	assert.NoError(t, db.Put([]byte("counter"), []byte("11")))
+
+	// the counter is always changed by others
+	db = New(WithMaxUpdateRetries(3))
+	var runs int
+	err = db.Update(func(txn *Transaction) error {
+		runs++
+		_, _ = txn.Get([]byte("counter"))
+		assert.NoError(t, db.Put([]byte("counter"), []byte(strconv.Itoa(runs))))
+		return txn.Put([]byte("counter"), []byte("0"))
+	})
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Equal(t, 4, runs)
+}
+
+func TestView(t *testing.T) {
+	t.Parallel()
+	db := New()
+	assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+
+	var tx ReadTx
+	err := db.View(func(rtx ReadTx) error {
+		tx = rtx
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("newval-1")))
+		v, err := rtx.Get([]byte("key-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-1", string(v))
+		return nil
+	})
+	assert.NoError(t, err)
+	// released after View
+	_, err = tx.Get([]byte("key-1"))
+	assert.ErrorIs(t, err, ErrReleasedSnapshot)
+
+	errFailed := errors.New("failed")
+	err = db.View(func(rtx ReadTx) error { return errFailed })
+	assert.ErrorIs(t, err, errFailed)
+}
+
+func TestSavepoint(t *testing.T) {
+	t.Run("rollback to", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		var events []string
+		_, err := db.AppendEventHook([]byte("key"), func(e Event) bool {
+			events = append(events, fmt.Sprintf("%s %s %s", e.Op, e.Key, e.Value))
+			return false
+		})
+		assert.NoError(t, err)
+
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("key-2"), []byte("val-2")))
+		assert.NoError(t, txn.PutWithTTL([]byte("key-3"), []byte("val-3"), time.Hour))
+		sp1 := txn.Savepoint()
+		assert.NoError(t, txn.Put([]byte("key-2"), []byte("newval-2")))
+		assert.NoError(t, txn.Delete([]byte("key-1")))
+		assert.NoError(t, txn.Put([]byte("key-3"), []byte("newval-3")))
+		sp2 := txn.Savepoint()
+		assert.NoError(t, txn.Put([]byte("key-4"), []byte("val-4")))
+
+		assert.NoError(t, txn.RollbackTo(sp1))
+		assert.ErrorIs(t, txn.RollbackTo(sp2), ErrInvalidSavepoint)
+		var got []string
+		for kv, err := range txn.QueryKV(context.Background(), []byte("key")) {
+			assert.NoError(t, err)
+			got = append(got, string(kv.Key)+"="+string(kv.Value))
+		}
+		assert.Equal(t, []string{"key-1=val-1", "key-2=val-2", "key-3=val-3"}, got)
+
+		// sp1 is still valid
+		assert.NoError(t, txn.Put([]byte("key-5"), []byte("val-5")))
+		assert.NoError(t, txn.RollbackTo(sp1))
+		assert.NoError(t, txn.Commit())
+		assert.ErrorIs(t, txn.RollbackTo(sp1), ErrClosedTransaction)
+
+		assert.Equal(t, []string{"put key-2 val-2", "put key-3 val-3"}, events)
+		v, err := db.Get([]byte("key-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-1", string(v))
+		_, err = db.Get([]byte("key-5"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		// the ttl of key-3 is restored
+		exp := db.l3.(*l3Store).l2values.l1Store.(*l1BaseStore[[]byte]).exps
+		assert.Len(t, exp, 1)
+	})
+
+	t.Run("hooks", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var called []string
+		txn := db.Transaction()
+		sp := txn.Savepoint()
+		_, err := txn.AppendHook([]byte("key"), func(k, v []byte) (removeHook bool) {
+			called = append(called, string(k))
+			return false
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.RollbackTo(sp))
+		assert.NoError(t, txn.Put([]byte("key-1"), []byte("val-1")))
+		assert.NoError(t, txn.Commit())
+		assert.Empty(t, called)
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("key-1"), []byte("val-1")))
+
+		nested := txn.Transaction()
+		assert.NoError(t, nested.Put([]byte("key-2"), []byte("val-2")))
+		inner := nested.Transaction()
+		assert.NoError(t, inner.Put([]byte("key-3"), []byte("val-3")))
+		assert.NoError(t, inner.Rollback())
+		assert.ErrorIs(t, inner.Commit(), ErrClosedTransaction)
+		assert.NoError(t, nested.Commit())
+
+		nested = txn.Transaction()
+		assert.NoError(t, nested.Delete([]byte("key-1")))
+		assert.NoError(t, nested.Rollback())
+
+		// nothing is applied until the outermost commit
+		_, err := db.Get([]byte("key-2"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		assert.NoError(t, txn.Commit())
+
+		for k, want := range map[string]string{"key-1": "val-1", "key-2": "val-2"} {
+			v, err := db.Get([]byte(k))
+			assert.NoError(t, err)
+			assert.Equal(t, want, string(v))
+		}
+		_, err = db.Get([]byte("key-3"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+}
+
+func TestConditionalWrite(t *testing.T) {
+	t.Run("db", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var events []string
+		_, err := db.AppendEventHook([]byte("lease"), func(e Event) bool {
+			events = append(events, fmt.Sprintf("%s %s", e.Op, e.Value))
+			return false
+		})
+		assert.NoError(t, err)
+
+		ok, err := db.PutIfAbsent([]byte("lease"), []byte("node-1"))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = db.PutIfAbsent([]byte("lease"), []byte("node-2"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = db.CompareAndSwap([]byte("lease"), []byte("node-2"), []byte("node-3"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		ok, err = db.CompareAndSwap([]byte("lease"), []byte("node-1"), []byte("node-2"))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = db.CompareAndSwap([]byte("missing"), nil, []byte("node-1"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = db.DeleteIfEquals([]byte("lease"), []byte("node-1"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		ok, err = db.DeleteIfEquals([]byte("lease"), []byte("node-2"))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = db.DeleteIfEquals([]byte("lease"), []byte("node-2"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		_, err = db.PutIfAbsent(nil, []byte("node-1"))
+		assert.ErrorIs(t, err, ErrEmptyEntry)
+		assert.Equal(t, []string{"put node-1", "put node-2", "delete "}, events)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var (
+			wg      sync.WaitGroup
+			applied atomic.Int32
+		)
+		for i := range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := db.PutIfAbsent([]byte("lease"), []byte(fmt.Sprint(i)))
+				assert.NoError(t, err)
+				if ok {
+					applied.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), applied.Load())
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		assert.NoError(t, db.Put([]byte("lease"), []byte("node-1")))
+		txn := db.Transaction()
+		ok, err := txn.CompareAndSwap([]byte("lease"), []byte("node-1"), []byte("node-2"))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = txn.PutIfAbsent([]byte("lease"), []byte("node-3"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		// not applied until commit
+		v, err := db.Get([]byte("lease"))
+		assert.NoError(t, err)
+		assert.Equal(t, "node-1", string(v))
+		assert.NoError(t, txn.Commit())
+		v, err = db.Get([]byte("lease"))
+		assert.NoError(t, err)
+		assert.Equal(t, "node-2", string(v))
+	})
+}
+
+func TestEventHook(t *testing.T) {
+	t.Run("put and delete", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var events []Event
+		_, err := db.AppendEventHook([]byte("GAME100#"), func(e Event) (removeHook bool) {
+			events = append(events, e)
+			return false
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("GAME100#ACT1"), []byte("KICK")))
+		assert.NoError(t, db.Put([]byte("GAME100#ACT1"), []byte("PUNCH")))
+		assert.NoError(t, db.Delete([]byte("GAME100#ACT1")))
+		assert.NoError(t, db.Put([]byte("GAME999#ACT1"), []byte("KICK")))
+
+		assert.Equal(t, []Event{
+			{Op: OpPut, Key: []byte("GAME100#ACT1"), Value: []byte("KICK"), Seq: 1},
+			{Op: OpPut, Key: []byte("GAME100#ACT1"), Value: []byte("PUNCH"), Prev: []byte("KICK"), Seq: 2},
+			{Op: OpDelete, Key: []byte("GAME100#ACT1"), Prev: []byte("PUNCH"), Seq: 3},
+		}, events)
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		assert.NoError(t, db.Put([]byte("key-2"), []byte("val-2")))
+		var events []Event
+		_, err := db.AppendEventHook([]byte("key"), func(e Event) (removeHook bool) {
+			events = append(events, e)
+			return false
+		})
+		assert.NoError(t, err)
+
+		txn := db.Transaction()
+		assert.NoError(t, txn.Delete([]byte("key-1")))
+		assert.NoError(t, txn.Put([]byte("key-2"), []byte("newval-2")))
+		assert.NoError(t, txn.Put([]byte("key-3"), []byte("val-3")))
+		assert.NoError(t, txn.Delete([]byte("key-3")))
+		assert.Empty(t, events)
+		assert.NoError(t, txn.Commit())
+
+		assert.Equal(t, []Event{
+			{Op: OpDelete, Key: []byte("key-1"), Prev: []byte("val-1"), Seq: 3},
+			{Op: OpPut, Key: []byte("key-2"), Value: []byte("newval-2"), Prev: []byte("val-2"), Seq: 4},
+		}, events)
+	})
+
+	t.Run("put hook ignores delete", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var calledKeys []string
+		_, err := db.AppendHook([]byte("key"), func(k, v []byte) (removeHook bool) {
+			calledKeys = append(calledKeys, string(k))
+			return false
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		assert.NoError(t, db.Delete([]byte("key-1")))
+		assert.Equal(t, []string{"key-1"}, calledKeys)
+	})
+}
+
+func TestContextHook(t *testing.T) {
+	t.Run("derived key", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		// keep the latest order of each user
+		_, err := db.AppendContextHook([]byte("order#"), func(hc *HookContext, e Event) bool {
+			switch e.Op {
+			case OpPut:
+				user, _, _ := bytes.Cut(e.Value, []byte(":"))
+				hc.Put(append([]byte("latest#"), user...), e.Key)
+			case OpDelete:
+				user, _, _ := bytes.Cut(e.Prev, []byte(":"))
+				hc.Delete(append([]byte("latest#"), user...))
+			}
+			return false
+		})
+		assert.NoError(t, err)
+		var depths []int
+		_, err = db.AppendContextHook([]byte("latest#"), func(hc *HookContext, e Event) bool {
+			depths = append(depths, hc.Depth())
+			return false
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("order#1"), []byte("alice:shoes")))
+		assert.NoError(t, db.Put([]byte("order#2"), []byte("alice:hat")))
+		v, err := db.Get([]byte("latest#alice"))
+		assert.NoError(t, err)
+		assert.Equal(t, "order#2", string(v))
+
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("order#3"), []byte("bob:gloves")))
+		assert.NoError(t, txn.Commit())
+		v, err = db.Get([]byte("latest#bob"))
+		assert.NoError(t, err)
+		assert.Equal(t, "order#3", string(v))
+
+		assert.NoError(t, db.Delete([]byte("order#3")))
+		_, err = db.Get([]byte("latest#bob"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		assert.Equal(t, []int{1, 1, 1, 1}, depths)
+	})
+
+	t.Run("sequence in transaction", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		_, err := db.AppendContextHook([]byte("order#"), func(hc *HookContext, e Event) bool {
+			hc.Put(append([]byte("latest#"), e.Value...), e.Key)
+			return false
+		})
+		assert.NoError(t, err)
+		var seqs []string
+		for _, prefix := range []string{"order#", "latest#"} {
+			_, err = db.AppendEventHook([]byte(prefix), func(e Event) bool {
+				seqs = append(seqs, fmt.Sprintf("%d %s", e.Seq, e.Key))
+				return false
+			})
+			assert.NoError(t, err)
+		}
+
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("order#1"), []byte("alice")))
+		assert.NoError(t, txn.Put([]byte("order#2"), []byte("bob")))
+		assert.NoError(t, txn.Commit())
+		// the writes of the transaction are numbered and delivered before the writes of its hooks
+		assert.Equal(t, []string{"1 order#1", "2 order#2", "3 latest#alice", "4 latest#bob"}, seqs)
+	})
+
+	t.Run("depth limit", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithMaxHookDepth(3))
+		// every write triggers another write
+		_, err := db.AppendContextHook([]byte("loop"), func(hc *HookContext, e Event) bool {
+			hc.Put(append(e.Key, '!'), e.Value)
+			return false
+		})
+		assert.NoError(t, err)
+
+		err = db.Put([]byte("loop"), []byte("val"))
+		assert.ErrorIs(t, err, ErrHookDepthExceeded)
+		for _, k := range []string{"loop", "loop!", "loop!!", "loop!!!"} {
+			_, err := db.Get([]byte(k))
+			assert.NoError(t, err, k)
+		}
+		_, err = db.Get([]byte("loop!!!!"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("depth limit in transaction", func(t *testing.T) {
+		t.Parallel()
+		var herrs []*HookError
+		db := New(WithMaxHookDepth(1), WithOnHookError(func(err *HookError) {
+			herrs = append(herrs, err)
+		}))
+		assert.NoError(t, db.Put([]byte("loop"), []byte("val")))
+		_, err := db.AppendContextHook([]byte("loop"), func(hc *HookContext, e Event) bool {
+			hc.Put(append(e.Key, '!'), e.Value)
+			return false
+		})
+		assert.NoError(t, err)
+
+		// the commit is kept even though the writes of hooks exceed the depth
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("loop"), []byte("newval")))
+		assert.NoError(t, txn.Commit())
+		require.Len(t, herrs, 1)
+		assert.ErrorIs(t, herrs[0], ErrHookDepthExceeded)
+		for _, k := range []string{"loop", "loop!"} {
+			v, err := db.Get([]byte(k))
+			assert.NoError(t, err, k)
+			assert.Equal(t, "newval", string(v), k)
+		}
+	})
+
+	t.Run("empty key", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir)
+		require.NoError(t, err)
+		_, err = db.AppendContextHook([]byte("key"), func(hc *HookContext, e Event) bool {
+			hc.Put(nil, e.Value)
+			return false
+		})
+		assert.NoError(t, err)
+		assert.ErrorIs(t, db.Put([]byte("key-1"), []byte("val-1")), ErrEmptyEntry)
+		require.NoError(t, db.Close())
+
+		// the empty key is not logged
+		db, err = Open(dir)
+		require.NoError(t, err)
+		defer db.Close()
+		v, err := db.Get([]byte("key-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-1", string(v))
+	})
+}
+
+func TestValidator(t *testing.T) {
+	newDB := func(t *testing.T) (*HookDB, *[]Event) {
+		db := New(WithMergeOperator([]byte("user#"), MergeAppend(nil)))
+		_, err := db.AppendValidator([]byte("user#"), func(k, v []byte) error {
+			if !json.Valid(v) {
+				return fmt.Errorf("invalid json: %s", v)
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		var events []Event
+		_, err = db.AppendEventHook([]byte("user#"), func(e Event) bool {
+			events = append(events, e)
+			return false
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("user#1"), []byte(`{"name":"alice"}`)))
+		events = events[:0]
+		return db, &events
+	}
+	assertUnchanged := func(t *testing.T, db *HookDB, events *[]Event) {
+		v, err := db.Get([]byte("user#1"))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"name":"alice"}`, string(v))
+		_, err = db.Get([]byte("user#2"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		assert.Empty(t, *events)
+	}
+
+	t.Run("put", func(t *testing.T) {
+		t.Parallel()
+		db, events := newDB(t)
+		err := db.Put([]byte("user#1"), []byte("alice"))
+		assert.ErrorIs(t, err, ErrInvalidValue)
+		assert.ErrorContains(t, err, "invalid json: alice")
+		ok, err := db.CompareAndSwap([]byte("user#1"), []byte(`{"name":"alice"}`), []byte("{"))
+		assert.ErrorIs(t, err, ErrInvalidValue)
+		assert.True(t, ok)
+		// other prefixes are not validated
+		assert.NoError(t, db.Put([]byte("group#1"), []byte("admins")))
+		assertUnchanged(t, db, events)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		t.Parallel()
+		db, events := newDB(t)
+		assert.ErrorIs(t, db.Merge([]byte("user#1"), []byte("}")), ErrInvalidValue)
+		assertUnchanged(t, db, events)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		t.Parallel()
+		db, events := newDB(t)
+		var b WriteBatch
+		b.Put([]byte("user#2"), []byte(`{"name":"bob"}`))
+		b.Put([]byte("user#1"), []byte("alice"))
+		assert.ErrorIs(t, db.Write(&b), ErrInvalidValue)
+		assertUnchanged(t, db, events)
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		t.Parallel()
+		db, events := newDB(t)
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("user#2"), []byte(`{"name":"bob"}`)))
+		assert.ErrorIs(t, txn.Put([]byte("user#1"), []byte("alice")), ErrInvalidValue)
+		// a validator appended in the transaction rejects the commit
+		_, err := txn.AppendValidator([]byte("user#2"), func(k, v []byte) error {
+			return errors.New("read only")
+		})
+		assert.NoError(t, err)
+		assert.ErrorIs(t, txn.Commit(), ErrInvalidValue)
+		assertUnchanged(t, db, events)
+
+		// only the last value of a key is validated
+		txn = db.Transaction()
+		assert.NoError(t, txn.Delete([]byte("user#1")))
+		assert.NoError(t, txn.Put([]byte("user#2"), []byte(`{"name":"bob"}`)))
+		assert.NoError(t, txn.Commit())
+		v, err := db.Get([]byte("user#2"))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"name":"bob"}`, string(v))
+	})
+
+	t.Run("hook", func(t *testing.T) {
+		t.Parallel()
+		db, events := newDB(t)
+		_, err := db.AppendContextHook([]byte("raw#"), func(hc *HookContext, e Event) bool {
+			hc.Put([]byte("user#2"), e.Value)
+			return false
+		})
+		assert.NoError(t, err)
+		assert.ErrorIs(t, db.Put([]byte("raw#2"), []byte("bob")), ErrInvalidValue)
+		assertUnchanged(t, db, events)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		id, err := db.AppendValidator([]byte("key"), func(k, v []byte) error {
+			return errors.New("read only")
+		})
+		assert.NoError(t, err)
+		assert.ErrorIs(t, db.Put([]byte("key-1"), []byte("val-1")), ErrInvalidValue)
+		assert.NoError(t, db.RemoveHookByID(id))
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+	})
+
+	t.Run("removed during transaction", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		_, err := db.AppendHook([]byte("key"), func(k, v []byte) bool { return false })
+		assert.NoError(t, err)
+		txn := db.Transaction()
+		// hooks removed since the transaction began are no hooks
+		assert.NoError(t, db.RemoveHook([]byte("key")))
+		assert.NoError(t, txn.Put([]byte("key1"), []byte("val1")))
+		assert.NoError(t, txn.Commit())
+		v, err := db.Get([]byte("key1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val1", string(v))
+	})
+}
+
+func TestHookPanic(t *testing.T) {
+	t.Run("put", func(t *testing.T) {
+		t.Parallel()
+		var herrs []*HookError
+		db := New(WithOnHookError(func(err *HookError) {
+			herrs = append(herrs, err)
+		}))
+		_, err := db.AppendContextHook([]byte("key"), func(hc *HookContext, e Event) bool {
+			hc.Put([]byte("derived"), e.Value)
+			panic("boom")
+		})
+		assert.NoError(t, err)
+		var called []string
+		_, err = db.AppendHook([]byte("ke"), func(k, v []byte) bool {
+			called = append(called, string(k))
+			return false
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		v, err := db.Get([]byte("key-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-1", string(v))
+		// the writes queued before the panic are discarded
+		_, err = db.Get([]byte("derived"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		assert.Equal(t, []string{"key-1"}, called)
+
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("key-2"), []byte("val-2")))
+		assert.NoError(t, txn.Put([]byte("key-3"), []byte("val-3")))
+		assert.NoError(t, txn.Commit())
+		for _, k := range []string{"key-2", "key-3"} {
+			_, err := db.Get([]byte(k))
+			assert.NoError(t, err, k)
+		}
+		assert.Equal(t, []string{"key-1", "key-2", "key-3"}, called)
+
+		require.Len(t, herrs, 3)
+		for n, herr := range herrs {
+			assert.Equal(t, "key", string(herr.Prefix))
+			assert.Equal(t, fmt.Sprintf("key-%d", n+1), string(herr.Key))
+			assert.Equal(t, "boom", herr.Value)
+			assert.Contains(t, string(herr.Stack), "TestHookPanic")
+		}
+		assert.EqualError(t, herrs[0], "hook of prefix 'key' panicked on key 'key-1': boom")
+	})
+
+	t.Run("error value", func(t *testing.T) {
+		t.Parallel()
+		errBoom := errors.New("boom")
+		var herr *HookError
+		db := New(WithOnHookError(func(err *HookError) {
+			herr = err
+		}))
+		_, err := db.AppendEventHook([]byte("key"), func(e Event) bool {
+			panic(errBoom)
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		assert.ErrorIs(t, herr, errBoom)
+	})
+
+	t.Run("async", func(t *testing.T) {
+		t.Parallel()
+		herrs := make(chan *HookError, 1)
+		db := New(WithOnHookError(func(err *HookError) {
+			herrs <- err
+		}))
+		defer db.Close()
+		var called atomic.Int32
+		_, err := db.AppendAsyncHook([]byte("key"), func(ctx context.Context, e Event) bool {
+			if called.Add(1) == 1 {
+				panic("boom")
+			}
+			return false
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-2")))
+		assert.NoError(t, db.WaitHooks(context.Background()))
+		assert.Equal(t, int32(2), called.Load())
+		herr := <-herrs
+		assert.Equal(t, "key-1", string(herr.Key))
+	})
+}
+
+func TestHookID(t *testing.T) {
+	t.Run("multiple hooks", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var called []string
+		id1, err := db.AppendHook([]byte("order"), func(k, v []byte) (removeHook bool) {
+			called = append(called, "hook-1")
+			return false
+		})
+		assert.NoError(t, err)
+		_, err = db.AppendHook([]byte("order"), func(k, v []byte) (removeHook bool) {
+			called = append(called, "hook-2")
+			return true
+		})
+		assert.NoError(t, err)
+		_, err = db.AppendHook([]byte("order"), func(k, v []byte) (removeHook bool) {
+			called = append(called, "hook-3")
+			return false
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("order1"), []byte("shoes")))
+		assert.Equal(t, []string{"hook-1", "hook-2", "hook-3"}, called)
+
+		// hook-2 is removed by itself
+		called = nil
+		assert.NoError(t, db.Put([]byte("order2"), []byte("hat")))
+		assert.Equal(t, []string{"hook-1", "hook-3"}, called)
+
+		called = nil
+		assert.NoError(t, db.RemoveHookByID(id1))
+		assert.ErrorIs(t, db.RemoveHookByID(id1), ErrKeyNotFound)
+		assert.NoError(t, db.Put([]byte("order3"), []byte("gloves")))
+		assert.Equal(t, []string{"hook-3"}, called)
+
+		called = nil
+		assert.NoError(t, db.RemoveHook([]byte("order")))
+		assert.NoError(t, db.Put([]byte("order4"), []byte("socks")))
+		assert.Empty(t, called)
+	})
+
+	t.Run("subscribe twice", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		ctx1, cancel1 := context.WithCancel(context.Background())
+		ch1, err := db.Subscribe(ctx1, []byte("order"))
+		assert.NoError(t, err)
+		ch2, err := db.Subscribe(context.Background(), []byte("order"), WithOnceSubscription())
+		assert.NoError(t, err)
+
+		// first subscription ends and removes its hook only
+		cancel1()
+		for range ch1 {
+		}
+		assert.NoError(t, db.Put([]byte("order1"), []byte("shoes")))
+		assert.Equal(t, "shoes", string(<-ch2))
+	})
+}
+
+func TestQueryKV(t *testing.T) {
+	t.Parallel()
+	db := New()
+	assert.NoError(t, db.Put([]byte("user02"), []byte("bob")))
+	assert.NoError(t, db.Put([]byte("user01"), []byte("alice")))
+	assert.NoError(t, db.Put([]byte("user03"), []byte("carol")))
+	assert.NoError(t, db.Put([]byte("item01"), []byte("shoes")))
+	assert.NoError(t, db.Delete([]byte("user03")))
+
+	txn := db.Transaction()
+	assert.NoError(t, txn.Put([]byte("user04"), []byte("dave")))
+	assert.NoError(t, txn.Delete([]byte("user01")))
+
+	test := []struct {
+		name string
+		db   *DB
+		opts []QueryOption
+		want []string
+	}{
+		{"db", db.DB, nil, []string{"user01=alice", "user02=bob"}},
+		{"reverse", db.DB, []QueryOption{WithReverseQuery()}, []string{"user02=bob", "user01=alice"}},
+		{"keys only", db.DB, []QueryOption{WithKeysOnly()}, []string{"user01=", "user02="}},
+		{"limit", db.DB, []QueryOption{WithKeysOnly(), WithLimit(1)}, []string{"user01="}},
+		{"transaction", txn.DB, nil, []string{"user02=bob", "user04=dave"}},
+		{"transaction keys only", txn.DB, []QueryOption{WithKeysOnly()}, []string{"user02=", "user04="}},
+	}
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for kv, err := range tt.db.QueryKV(context.Background(), []byte("user"), tt.opts...) {
+				assert.NoError(t, err)
+				got = append(got, string(kv.Key)+"="+string(kv.Value))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	assert.NoError(t, txn.Rollback())
+}
+
+func TestNewSnapshot(t *testing.T) {
+	t.Run("frozen view", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		assert.NoError(t, db.Put([]byte("user01"), []byte("alice")))
+		assert.NoError(t, db.Put([]byte("user02"), []byte("bob")))
+		assert.NoError(t, db.PutWithTTL([]byte("user03"), []byte("carol"), time.Hour))
+
+		snap := db.NewSnapshot()
+		assert.NoError(t, db.Put([]byte("user01"), []byte("alice2")))
+		assert.NoError(t, db.Delete([]byte("user02")))
+		assert.NoError(t, db.Put([]byte("user03"), []byte("carol2")))
+		assert.NoError(t, db.Put([]byte("user04"), []byte("dave")))
+
+		v, err := snap.Get([]byte("user02"))
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", string(v))
+		_, err = snap.Get([]byte("user04"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		var got []string
+		for kv, err := range snap.QueryKV(context.Background(), []byte("user")) {
+			assert.NoError(t, err)
+			got = append(got, string(kv.Key)+"="+string(kv.Value))
+		}
+		assert.Equal(t, []string{"user01=alice", "user02=bob", "user03=carol"}, got)
+
+		snap.Release()
+		snap.Release()
+		_, err = snap.Get([]byte("user01"))
+		assert.ErrorIs(t, err, ErrReleasedSnapshot)
+		l1 := db.l3.(*l3Store).l2values.l1Store.(*l1BaseStore[[]byte])
+		assert.Zero(t, l1.snapshots)
+		assert.Empty(t, l1.frozen)
+	})
+
+	t.Run("query with concurrent writes", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		for i := range 100 {
+			k := fmt.Sprintf("key%03d", i)
+			assert.NoError(t, db.Put([]byte(k), []byte(k)))
+		}
+		done := make(chan struct{})
+		write := func() {
+			defer close(done)
+			for i := range 100 {
+				k := fmt.Sprintf("key%03d", i)
+				assert.NoError(t, db.Delete([]byte(k)))
+				assert.NoError(t, db.Put([]byte(k+"x"), []byte(k)))
+			}
+		}
+		var got []string
+		for v, err := range db.Query(context.Background(), []byte("key")) {
+			assert.NoError(t, err)
+			if len(got) == 0 {
+				go write()
+			}
+			got = append(got, string(v))
+			// writes in the loop are not visible to the iteration
+			assert.NoError(t, db.Put(append(v, 'y'), v))
+		}
+		<-done
+		assert.Len(t, got, 100)
+		for i, v := range got {
+			assert.Equal(t, fmt.Sprintf("key%03d", i), v)
+		}
+	})
+}
+
+func TestContext(t *testing.T) {
+	t.Run("query", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		for i := range 10 {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var (
+			n    int
+			errs []error
+		)
+		for _, err := range db.Query(ctx, []byte("key")) {
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			n++
+			if n == 3 {
+				cancel()
+			}
+		}
+		assert.Equal(t, 3, n)
+		assert.Len(t, errs, 1)
+		assert.ErrorIs(t, errs[0], context.Canceled)
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		assert.NoError(t, db.Put([]byte("key"), []byte("val")))
+		txn := db.TransactionWithLock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, db.PutContext(ctx, []byte("key"), []byte("newval")), context.DeadlineExceeded)
+		assert.ErrorIs(t, db.DeleteContext(ctx, []byte("key")), context.DeadlineExceeded)
+		_, err := db.GetContext(ctx, []byte("key"))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		assert.NoError(t, txn.Commit())
+		v, err := db.GetContext(context.Background(), []byte("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val", string(v))
+		assert.NoError(t, db.PutContext(context.Background(), []byte("key"), []byte("newval")))
+		assert.NoError(t, db.DeleteContext(context.Background(), []byte("key")))
+	})
+}
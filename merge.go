@@ -0,0 +1,91 @@
+package hookdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// MergeOperator combines an operand given to Merge with the existing value of a key.
+// existing is nil if the key does not exist. The returned value is put to the key.
+type MergeOperator func(existing, operand []byte) ([]byte, error)
+
+// MergeInt64Add adds the operand to the existing value. Both are decimal int64,
+// and a missing key counts as 0.
+func MergeInt64Add(existing, operand []byte) ([]byte, error) {
+	x, y, err := parseInt64Operands(existing, operand)
+	if err != nil {
+		return nil, err
+	}
+	return strconv.AppendInt(nil, x+y, 10), nil
+}
+
+// MergeInt64Max keeps the larger of the existing value and the operand, both decimal int64.
+func MergeInt64Max(existing, operand []byte) ([]byte, error) {
+	x, y, err := parseInt64Operands(existing, operand)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return strconv.AppendInt(nil, y, 10), nil
+	}
+	return strconv.AppendInt(nil, max(x, y), 10), nil
+}
+
+func parseInt64Operands(existing, operand []byte) (x, y int64, err error) {
+	if existing != nil {
+		if x, err = strconv.ParseInt(string(existing), 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("merge: existing value: %w", err)
+		}
+	}
+	if y, err = strconv.ParseInt(string(operand), 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("merge: operand: %w", err)
+	}
+	return x, y, nil
+}
+
+// MergeAppend returns a MergeOperator appending the operand to the existing value,
+// separated by sep.
+func MergeAppend(sep []byte) MergeOperator {
+	return func(existing, operand []byte) ([]byte, error) {
+		if existing == nil {
+			return bytes.Clone(operand), nil
+		}
+		v := make([]byte, 0, len(existing)+len(sep)+len(operand))
+		v = append(v, existing...)
+		v = append(v, sep...)
+		return append(v, operand...), nil
+	}
+}
+
+// mergeOperator returns the operator of the longest prefix of k.
+func (s *l3Store) mergeOperator(k []byte) (MergeOperator, bool) {
+	for i := len(k); 0 < i; i-- {
+		if op, found := s.merges[string(k[:i])]; found {
+			return op, true
+		}
+	}
+	return nil, false
+}
+
+func (s *l3Store) Merge(k, operand []byte) error {
+	op, found := s.mergeOperator(k)
+	if !found {
+		return fmt.Errorf("%w: '%s'", ErrNoMergeOperator, k)
+	}
+	if err := s.lockWrite(context.Background()); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	existing, err := s.get(k)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	v, err := op(existing, operand)
+	if err != nil {
+		return err
+	}
+	return s.put(k, v, 0)
+}
@@ -0,0 +1,110 @@
+package hookdb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeOperator(t *testing.T) {
+	test := []struct {
+		name     string
+		op       MergeOperator
+		existing []byte
+		operand  []byte
+		want     string
+		wantErr  bool
+	}{
+		{"add", MergeInt64Add, []byte("10"), []byte("-3"), "7", false},
+		{"add missing", MergeInt64Add, nil, []byte("5"), "5", false},
+		{"add invalid", MergeInt64Add, []byte("ten"), []byte("1"), "", true},
+		{"max", MergeInt64Max, []byte("10"), []byte("3"), "10", false},
+		{"max missing", MergeInt64Max, nil, []byte("-3"), "-3", false},
+		{"max invalid", MergeInt64Max, []byte("10"), []byte("x"), "", true},
+		{"append", MergeAppend([]byte(",")), []byte("a,b"), []byte("c"), "a,b,c", false},
+		{"append missing", MergeAppend([]byte(",")), nil, []byte("a"), "a", false},
+	}
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.op(tt.existing, tt.operand)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	t.Run("db", func(t *testing.T) {
+		t.Parallel()
+		db := New(
+			WithMergeOperator([]byte("count"), MergeInt64Add),
+			WithMergeOperator([]byte("count#max"), MergeInt64Max),
+		)
+		var got []string
+		_, err := db.AppendHook([]byte("count"), func(k, v []byte) (removeHook bool) {
+			got = append(got, fmt.Sprintf("%s=%s", k, v))
+			return false
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.Merge([]byte("count#1"), []byte("1")))
+		assert.NoError(t, db.Merge([]byte("count#1"), []byte("2")))
+		assert.NoError(t, db.Merge([]byte("count#max"), []byte("5")))
+		assert.NoError(t, db.Merge([]byte("count#max"), []byte("2")))
+		assert.Error(t, db.Merge([]byte("count#1"), []byte("x")))
+		assert.ErrorIs(t, db.Merge([]byte("other"), []byte("1")), ErrNoMergeOperator)
+		assert.Equal(t, []string{"count#1=1", "count#1=3", "count#max=5", "count#max=5"}, got)
+
+		txn := db.Transaction()
+		assert.NoError(t, txn.Merge([]byte("count#1"), []byte("10")))
+		assert.NoError(t, txn.Commit())
+		v, err := db.Get([]byte("count#1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "13", string(v))
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		t.Parallel()
+		db := New(WithMergeOperator([]byte("count"), MergeInt64Add))
+		var wg sync.WaitGroup
+		for range 100 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, db.Merge([]byte("count"), []byte("1")))
+			}()
+		}
+		wg.Wait()
+		v, err := db.Get([]byte("count"))
+		assert.NoError(t, err)
+		assert.Equal(t, "100", string(v))
+	})
+
+	t.Run("persistent", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir, WithMergeOperator([]byte("log"), MergeAppend([]byte("\n"))))
+		require.NoError(t, err)
+		assert.NoError(t, db.Merge([]byte("log"), []byte("a")))
+		assert.NoError(t, db.Merge([]byte("log"), []byte("b")))
+		require.NoError(t, db.Close())
+
+		// the merged values are logged, so no operator is needed to reopen
+		db, err = Open(dir)
+		require.NoError(t, err)
+		defer db.Close()
+		v, err := db.Get([]byte("log"))
+		assert.NoError(t, err)
+		assert.Equal(t, "a\nb", string(v))
+	})
+
+	_, err := Open(t.TempDir(), WithMergeOperator(nil, MergeInt64Add))
+	assert.ErrorIs(t, err, ErrEmptyEntry)
+}
@@ -1,7 +1,238 @@
 package hookdb
 
+import (
+	"fmt"
+	"time"
+)
+
+// Options configures a database created by New, Open or Restore.
+// CompactionSize, SyncMode and SyncInterval only apply to databases created by Open.
+type Options struct {
+	CompactionSize *int64 // default 64MiB
+	SyncMode       SyncMode
+	SyncInterval   *time.Duration // default 100ms
+	ChangeLogSize  *int           // default 1024
+	ExpiryInterval *time.Duration // default 1s
+	// MergeOperators maps key prefixes to the operators used by Merge
+	MergeOperators   map[string]MergeOperator
+	MaxHookDepth     *int // default 8
+	HookWorkers      *int // default 4
+	HookQueueSize    *int // default 1024
+	MaxUpdateRetries *int // default 10
+	// OnHookError is called with panics recovered from hooks and errors of hooks
+	// of committed transactions, which are ignored if nil
+	OnHookError func(err *HookError)
+}
+
+func (o *Options) getOnHookError() func(err *HookError) {
+	if o.OnHookError == nil {
+		return func(*HookError) {}
+	}
+	return o.OnHookError
+}
+
+func (o *Options) getHookWorkers() int {
+	if o.HookWorkers == nil {
+		return 4
+	}
+	return *o.HookWorkers
+}
+
+func (o *Options) getHookQueueSize() int {
+	if o.HookQueueSize == nil {
+		return 1024
+	}
+	return *o.HookQueueSize
+}
+
+func (o *Options) getMaxUpdateRetries() int {
+	if o.MaxUpdateRetries == nil {
+		return 10
+	}
+	return *o.MaxUpdateRetries
+}
+
+func (o *Options) getMaxHookDepth() int {
+	if o.MaxHookDepth == nil {
+		return 8
+	}
+	return *o.MaxHookDepth
+}
+
+func (o *Options) getExpiryInterval() time.Duration {
+	if o.ExpiryInterval == nil {
+		return time.Second
+	}
+	return *o.ExpiryInterval
+}
+
+func (o *Options) getChangeLogSize() int {
+	if o.ChangeLogSize == nil {
+		return 1024
+	}
+	return *o.ChangeLogSize
+}
+
+func (o *Options) getCompactionSize() int64 {
+	if o.CompactionSize == nil {
+		return 64 << 20
+	}
+	return *o.CompactionSize
+}
+
+func (o *Options) getSyncInterval() time.Duration {
+	if o.SyncInterval == nil {
+		return 100 * time.Millisecond
+	}
+	return *o.SyncInterval
+}
+
+type Option func(*Options) error
+
+// SyncMode determines when the write-ahead log is synced to stable storage.
+type SyncMode int
+
+const (
+	// SyncNone leaves flushing of the log to the OS.
+	// Writes survive a crash of the process but may be lost on power loss.
+	SyncNone SyncMode = iota
+	// SyncAlways syncs the log before each Put, Delete and Transaction.Commit returns,
+	// so a write that returned a nil error survives power loss.
+	SyncAlways
+	// SyncPeriodic syncs the log in the background every sync interval.
+	// Writes made within the last interval may be lost on power loss.
+	SyncPeriodic
+)
+
+// WithSyncMode sets when the write-ahead log is synced to stable storage. The default is SyncNone.
+func WithSyncMode(mode SyncMode) Option {
+	return func(o *Options) error {
+		o.SyncMode = mode
+		return nil
+	}
+}
+
+// WithSyncInterval sets the interval of background syncs used by SyncPeriodic.
+func WithSyncInterval(d time.Duration) Option {
+	return func(o *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("sync interval must be positive: %s", d)
+		}
+		o.SyncInterval = &d
+		return nil
+	}
+}
+
+// WithChangeLogSize sets the number of latest writes kept in memory
+// for subscriptions with WithStartFrom.
+func WithChangeLogSize(size int) Option {
+	return func(o *Options) error {
+		if size < 0 {
+			return fmt.Errorf("change log size must not be negative: %d", size)
+		}
+		o.ChangeLogSize = &size
+		return nil
+	}
+}
+
+// WithExpiryInterval sets the interval at which expired keys are removed in the background.
+func WithExpiryInterval(d time.Duration) Option {
+	return func(o *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("expiry interval must be positive: %s", d)
+		}
+		o.ExpiryInterval = &d
+		return nil
+	}
+}
+
+// WithCompactionSize sets the size in bytes of the write-ahead log
+// above which the log is rewritten from a snapshot of the current keys.
+func WithCompactionSize(size int64) Option {
+	return func(o *Options) error {
+		o.CompactionSize = &size
+		return nil
+	}
+}
+
+// WithMergeOperator registers op to combine operands given to Merge with the values
+// of keys with the prefix. For a key matching several prefixes, the longest one is used.
+func WithMergeOperator(prefix []byte, op MergeOperator) Option {
+	return func(o *Options) error {
+		if len(prefix) == 0 || op == nil {
+			return ErrEmptyEntry
+		}
+		if o.MergeOperators == nil {
+			o.MergeOperators = make(map[string]MergeOperator)
+		}
+		o.MergeOperators[string(prefix)] = op
+		return nil
+	}
+}
+
+// WithMaxHookDepth limits how deep writes from hooks added by AppendContextHook
+// can trigger hooks that write again. With 0, hooks cannot write.
+func WithMaxHookDepth(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("max hook depth must not be negative: %d", n)
+		}
+		o.MaxHookDepth = &n
+		return nil
+	}
+}
+
+// WithMaxUpdateRetries sets how many times HookDB.Update runs the function again
+// after the commit fails with ErrConflict. With 0, it is not run again.
+func WithMaxUpdateRetries(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("max update retries must not be negative: %d", n)
+		}
+		o.MaxUpdateRetries = &n
+		return nil
+	}
+}
+
+// WithHookWorkers sets the number of goroutines running hooks added by AppendAsyncHook.
+func WithHookWorkers(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("hook workers must be positive: %d", n)
+		}
+		o.HookWorkers = &n
+		return nil
+	}
+}
+
+// WithHookQueueSize sets the number of events queued for async hooks
+// above which writes wait for the hooks to catch up.
+func WithHookQueueSize(size int) Option {
+	return func(o *Options) error {
+		if size <= 0 {
+			return fmt.Errorf("hook queue size must be positive: %d", size)
+		}
+		o.HookQueueSize = &size
+		return nil
+	}
+}
+
+// WithOnHookError sets fn to be called with the panics recovered from hooks,
+// and the errors of hooks of committed transactions.
+// fn is called while the database is locked unless the hook is added by AppendAsyncHook,
+// so like HookHandler, it must not call methods of the database.
+func WithOnHookError(fn func(err *HookError)) Option {
+	return func(o *Options) error {
+		o.OnHookError = fn
+		return nil
+	}
+}
+
 type QueryOptions struct {
-	Reverse bool
+	Reverse    bool
+	Limit      int
+	StartAfter []byte
+	KeysOnly   bool
 }
 type QueryOption func(*QueryOptions) error
 
@@ -12,11 +243,57 @@ func WithReverseQuery() QueryOption {
 	}
 }
 
+// WithLimit limits the number of entries a query yields to n. n <= 0 means no limit.
+func WithLimit(n int) QueryOption {
+	return func(qo *QueryOptions) error {
+		qo.Limit = n
+		return nil
+	}
+}
+
+// WithStartAfter makes a query start right after the key in the order of the query,
+// which is the last key of the previous page when paging through keys.
+func WithStartAfter(key []byte) QueryOption {
+	return func(qo *QueryOptions) error {
+		qo.StartAfter = key
+		return nil
+	}
+}
+
+// WithKeysOnly makes QueryKV yield keys without reading their values.
+// KV.Value is nil.
+func WithKeysOnly() QueryOption {
+	return func(qo *QueryOptions) error {
+		qo.KeysOnly = true
+		return nil
+	}
+}
+
 type SubscribeOptions struct {
-	Once    bool
-	BufSize *int // default 1
+	Once           bool
+	BufSize        *int // default 1
+	OverflowPolicy OverflowPolicy
+	Stats          *SubscriptionStats
+	StartFrom      *uint64
+	ReplayExisting bool
 }
 
+// OverflowPolicy determines what a subscription does with a new event
+// when its buffer is full because the subscriber is slower than writers.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the writer until the subscriber receives an event.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the new event.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest event in the buffer to make room for the new event.
+	OverflowDropOldest
+	// OverflowDisconnect closes the subscription after the buffered events are received.
+	// SubscriptionStats.Err reports ErrSlowSubscriber.
+	OverflowDisconnect
+)
+
 func (so *SubscribeOptions) getBufSize() int {
 	if so.BufSize == nil {
 		return 1
@@ -43,3 +320,42 @@ func WithBufSize(size int) SubscribeOption {
 		return nil
 	}
 }
+
+// WithOverflowPolicy sets what the subscription does when its buffer is full.
+// The default is OverflowBlock.
+func WithOverflowPolicy(policy OverflowPolicy) SubscribeOption {
+	return func(seo *SubscribeOptions) error {
+		seo.OverflowPolicy = policy
+		return nil
+	}
+}
+
+// WithSubscriptionStats sets stats to be updated with the state of the subscription.
+func WithSubscriptionStats(stats *SubscriptionStats) SubscribeOption {
+	return func(seo *SubscribeOptions) error {
+		seo.Stats = stats
+		return nil
+	}
+}
+
+// WithStartFrom makes the subscription first send the past events with Event.Seq at or after seq,
+// and then the events of new writes. Past events are kept in memory up to the change log size
+// of the database, and Subscribe returns ErrSeqNotRetained if some of them are no longer kept,
+// which is always the case for past writes right after a persistent database is reopened.
+// Subscribe returns ErrFutureSeq if seq is after the Seq of the next write.
+func WithStartFrom(seq uint64) SubscribeOption {
+	return func(seo *SubscribeOptions) error {
+		seo.StartFrom = &seq
+		return nil
+	}
+}
+
+// WithReplayExisting makes the subscription first send the existing keys with the prefix
+// as OpPut events, and then the events of new writes.
+// The Event.Seq of existing keys is the sequence number of the last write before the subscription.
+func WithReplayExisting() SubscribeOption {
+	return func(seo *SubscribeOptions) error {
+		seo.ReplayExisting = true
+		return nil
+	}
+}
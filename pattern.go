@@ -0,0 +1,228 @@
+package hookdb
+
+import (
+	"bytes"
+	"slices"
+)
+
+// Pattern matches keys for hooks added by AppendPatternHook.
+// A hook of a pattern is indexed under the literal prefix of the pattern, the bytes every
+// matching key starts with, so only the patterns whose literal prefix is a prefix of a written
+// key are looked up. The patterns of a literal prefix are kept in a trie that is matched
+// against the key byte by byte, so the time to match a key does not grow with the number
+// of patterns sharing the literal prefix. Patterns starting with a wildcard share the trie
+// of the empty prefix.
+type Pattern struct {
+	pattern []byte
+	// alts are the sequences of tokens of which the pattern matches any
+	alts   [][]patternToken
+	prefix []byte
+}
+
+type (
+	patternToken struct {
+		kind patternKind
+		// b is the byte of a literal, or the separator of anySegment
+		b byte
+	}
+	patternKind byte
+)
+
+const (
+	literal patternKind = iota
+	anyByte
+	anyBytes
+	// anySegment matches any bytes but the separator
+	anySegment
+)
+
+// Glob returns a pattern where '*' matches any sequence of bytes, including none,
+// and '?' matches any single byte. Other bytes match themselves.
+// For example, "GAME*#ACT*" matches the ACT keys of every game.
+func Glob(pattern []byte) Pattern {
+	tokens := make([]patternToken, 0, len(pattern))
+	for _, b := range pattern {
+		switch b {
+		case '*':
+			tokens = append(tokens, patternToken{kind: anyBytes})
+		case '?':
+			tokens = append(tokens, patternToken{kind: anyByte})
+		default:
+			tokens = append(tokens, patternToken{kind: literal, b: b})
+		}
+	}
+	return newPattern(pattern, [][]patternToken{tokens})
+}
+
+// Segments returns a pattern matching keys split into segments by sep, where a segment "*"
+// matches any single segment and a segment "**" matches any number of segments, including none.
+// Other segments match themselves.
+// For example, with '/', "users/*/orders/**" matches "users/1/orders" and "users/1/orders/2/items".
+func Segments(pattern []byte, sep byte) Pattern {
+	if len(pattern) == 0 {
+		return Pattern{}
+	}
+	// "**" matches either no segment, or one or more segments as any bytes
+	alts := [][][]patternToken{nil}
+	for _, seg := range bytes.Split(pattern, []byte{sep}) {
+		var tokens []patternToken
+		switch string(seg) {
+		case "**":
+			tokens = []patternToken{{kind: anyBytes}}
+		case "*":
+			tokens = []patternToken{{kind: anySegment, b: sep}}
+		default:
+			for _, b := range seg {
+				tokens = append(tokens, patternToken{kind: literal, b: b})
+			}
+		}
+		next := make([][][]patternToken, 0, 2*len(alts))
+		for _, segs := range alts {
+			if string(seg) == "**" {
+				next = append(next, segs)
+			}
+			next = append(next, append(slices.Clip(segs), tokens))
+		}
+		alts = next
+	}
+	joined := make([][]patternToken, 0, len(alts))
+	for _, segs := range alts {
+		if len(segs) == 0 {
+			continue
+		}
+		var tokens []patternToken
+		for n, seg := range segs {
+			if 0 < n {
+				tokens = append(tokens, patternToken{kind: literal, b: sep})
+			}
+			tokens = append(tokens, seg...)
+		}
+		joined = append(joined, tokens)
+	}
+	return newPattern(pattern, joined)
+}
+
+func newPattern(pattern []byte, alts [][]patternToken) Pattern {
+	// the literal prefix is the literal tokens all alternatives start with
+	var prefix []byte
+	for n, tokens := range alts {
+		var lit []byte
+		for _, t := range tokens {
+			if t.kind != literal {
+				break
+			}
+			lit = append(lit, t.b)
+		}
+		if n == 0 {
+			prefix = lit
+			continue
+		}
+		l := 0
+		for l < min(len(prefix), len(lit)) && prefix[l] == lit[l] {
+			l++
+		}
+		prefix = prefix[:l]
+	}
+	return Pattern{pattern: bytes.Clone(pattern), alts: alts, prefix: prefix}
+}
+
+// String returns the pattern as given.
+func (p Pattern) String() string {
+	return string(p.pattern)
+}
+
+// patternTrie matches a key against many patterns at once. Each node is reached by a token,
+// and the key is matched by following all the nodes its bytes can reach, like an NFA,
+// so that the patterns with common tokens are matched together.
+type patternTrie struct {
+	root patternNode
+}
+
+type patternNode struct {
+	token    patternToken
+	children map[patternToken]*patternNode
+	// wildcards are the children reached by anyBytes or anySegment, which can match no byte
+	wildcards []*patternNode
+	// ends are the indices of the patterns ending at the node
+	ends []int
+}
+
+// insert adds the tokens of the n-th pattern.
+func (t *patternTrie) insert(tokens []patternToken, n int) {
+	node := &t.root
+	for _, tok := range tokens {
+		child, found := node.children[tok]
+		if !found {
+			child = &patternNode{token: tok}
+			if node.children == nil {
+				node.children = make(map[patternToken]*patternNode)
+			}
+			node.children[tok] = child
+			if tok.kind == anyBytes || tok.kind == anySegment {
+				node.wildcards = append(node.wildcards, child)
+			}
+		}
+		node = child
+	}
+	node.ends = append(node.ends, n)
+}
+
+// match returns the indices of the patterns matching k in ascending order.
+func (t *patternTrie) match(k []byte) []int {
+	var (
+		states []*patternNode
+		seen   = make(map[*patternNode]bool)
+	)
+	var add func(node *patternNode)
+	add = func(node *patternNode) {
+		if node == nil || seen[node] {
+			return
+		}
+		seen[node] = true
+		states = append(states, node)
+		for _, w := range node.wildcards {
+			add(w)
+		}
+	}
+	add(&t.root)
+	for _, b := range k {
+		prev := states
+		states = make([]*patternNode, 0, len(prev))
+		clear(seen)
+		for _, node := range prev {
+			switch node.token.kind {
+			case anyBytes:
+				add(node)
+			case anySegment:
+				if b != node.token.b {
+					add(node)
+				}
+			}
+			add(node.children[patternToken{kind: literal, b: b}])
+			add(node.children[patternToken{kind: anyByte}])
+		}
+		if len(states) == 0 {
+			return nil
+		}
+	}
+	var matches []int
+	for _, node := range states {
+		matches = append(matches, node.ends...)
+	}
+	slices.Sort(matches)
+	return slices.Compact(matches)
+}
+
+func (s *l3Store) AppendPatternHook(p Pattern, fn EventHandler) (HookID, error) {
+	if len(p.pattern) == 0 {
+		return HookID{}, ErrEmptyEntry
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appendEntry(p.prefix, hookEntry{
+		fn: func(_ *HookContext, e Event) bool {
+			return fn(e)
+		},
+		pattern: &p,
+	})
+}
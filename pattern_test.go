@@ -0,0 +1,157 @@
+package hookdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPattern(t *testing.T) {
+	test := []struct {
+		p      Pattern
+		prefix string
+		match  []string
+		other  []string
+	}{
+		{Glob([]byte("GAME*#ACT*")), "GAME", []string{"GAME1#ACT1", "GAME#ACT", "GAME12#X#ACT3"}, []string{"GAME1#SCORE", "GAM1#ACT1", "XGAME1#ACT1"}},
+		{Glob([]byte("*#ACT?")), "", []string{"GAME1#ACT1", "#ACT*"}, []string{"GAME1#ACT", "GAME1#ACT12"}},
+		{Glob([]byte("a*b*c")), "a", []string{"abc", "aXbYc", "abbcc", "acbc"}, []string{"ab", "acb", "abcd"}},
+		{Glob([]byte("key")), "key", []string{"key"}, []string{"key1", "ke"}},
+		{Segments([]byte("users/*/orders"), '/'), "users/", []string{"users/1/orders"}, []string{"users/orders", "users/1/2/orders", "users/1/orders/2"}},
+		{Segments([]byte("users/*/orders/**"), '/'), "users/", []string{"users/1/orders", "users/1/orders/2/items"}, []string{"users/1/order"}},
+		{Segments([]byte("**/items"), '/'), "", []string{"items", "users/1/items"}, []string{"users/1/items/2"}},
+		{Segments([]byte("GAME1#*"), '#'), "GAME1#", []string{"GAME1#ACT1"}, []string{"GAME1#ACT1#X", "GAME12#ACT1"}},
+		{Segments([]byte("users/**"), '/'), "users", []string{"users", "users/", "users/1/orders"}, []string{"usersX", "user"}},
+		{Segments([]byte("a/**/**/b"), '/'), "a/", []string{"a/b", "a/1/b", "a/1/2/b"}, []string{"ab", "a/b/c"}},
+	}
+	for _, tt := range test {
+		assert.Equal(t, tt.prefix, string(tt.p.prefix), tt.p)
+		trie := &patternTrie{}
+		for _, tokens := range tt.p.alts {
+			trie.insert(tokens, 0)
+		}
+		for _, k := range tt.match {
+			assert.Equal(t, []int{0}, trie.match([]byte(k)), "%s: %s", tt.p, k)
+		}
+		for _, k := range tt.other {
+			assert.Empty(t, trie.match([]byte(k)), "%s: %s", tt.p, k)
+		}
+	}
+}
+
+func TestPatternTrie(t *testing.T) {
+	trie := &patternTrie{}
+	for n, p := range []Pattern{
+		Glob([]byte("GAME*#ACT1")),
+		Glob([]byte("GAME1#*")),
+		Glob([]byte("GAME?#ACT*")),
+		Segments([]byte("GAME1/*"), '/'),
+		Glob([]byte("GAME*#ACT1")),
+	} {
+		for _, tokens := range p.alts {
+			trie.insert(tokens, n)
+		}
+	}
+	assert.Equal(t, []int{0, 1, 2, 4}, trie.match([]byte("GAME1#ACT1")))
+	assert.Equal(t, []int{0, 4}, trie.match([]byte("GAME12#ACT1")))
+	assert.Equal(t, []int{2}, trie.match([]byte("GAME2#ACT2")))
+	assert.Equal(t, []int{3}, trie.match([]byte("GAME1/ACT1")))
+	assert.Empty(t, trie.match([]byte("GAME1/ACT1/2")))
+	assert.Empty(t, trie.match([]byte("SCORE")))
+}
+
+func TestPatternHook(t *testing.T) {
+	t.Run("match", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var called []string
+		_, err := db.AppendPatternHook(Glob([]byte("GAME*#ACT*")), func(e Event) bool {
+			called = append(called, fmt.Sprintf("%s %s", e.Op, e.Key))
+			return false
+		})
+		assert.NoError(t, err)
+		_, err = db.AppendPatternHook(Segments([]byte("*#SCORE"), '#'), func(e Event) bool {
+			called = append(called, fmt.Sprintf("score %s", e.Key))
+			return false
+		})
+		assert.NoError(t, err)
+		// other patterns under the same literal prefix are not called
+		for n := range 1000 {
+			_, err := db.AppendPatternHook(Glob([]byte(fmt.Sprintf("GAME%d#*", 1000+n))), func(e Event) bool {
+				called = append(called, fmt.Sprintf("game %s", e.Key))
+				return false
+			})
+			assert.NoError(t, err)
+		}
+
+		assert.NoError(t, db.Put([]byte("GAME1#ACT1"), []byte("KICK")))
+		assert.NoError(t, db.Put([]byte("GAME2#SCORE"), []byte("10")))
+		assert.NoError(t, db.Delete([]byte("GAME1#ACT1")))
+
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("GAME3#ACT1"), []byte("PUNCH")))
+		assert.NoError(t, txn.Commit())
+		assert.Equal(t, []string{"put GAME1#ACT1", "score GAME2#SCORE", "delete GAME1#ACT1", "put GAME3#ACT1"}, called)
+	})
+
+	t.Run("shared prefix", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var called []string
+		// patterns sharing the literal prefix "GAME", and patterns starting with a wildcard
+		for n := range 1000 {
+			_, err := db.AppendPatternHook(Glob([]byte(fmt.Sprintf("GAME*#ACT%d", n))), func(e Event) bool {
+				called = append(called, fmt.Sprintf("act%d %s", n, e.Key))
+				return false
+			})
+			assert.NoError(t, err)
+			_, err = db.AppendPatternHook(Segments([]byte(fmt.Sprintf("**/item%d", n)), '/'), func(e Event) bool {
+				called = append(called, fmt.Sprintf("item%d %s", n, e.Key))
+				return false
+			})
+			assert.NoError(t, err)
+		}
+
+		assert.NoError(t, db.Put([]byte("GAME1#ACT12"), []byte("KICK")))
+		assert.NoError(t, db.Put([]byte("users/1/item999"), []byte("1")))
+		assert.NoError(t, db.Put([]byte("GAME1#ACT1000"), []byte("KICK")))
+
+		txn := db.Transaction()
+		_, err := txn.AppendPatternHook(Glob([]byte("GAME*#ACT1")), func(e Event) bool {
+			called = append(called, fmt.Sprintf("txn %s", e.Key))
+			return false
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Put([]byte("GAME2#ACT1"), []byte("PUNCH")))
+		assert.NoError(t, txn.Commit())
+		assert.Equal(t, []string{"act12 GAME1#ACT12", "item999 users/1/item999", "act1 GAME2#ACT1", "txn GAME2#ACT1"}, called)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		var called []string
+		id, err := db.AppendPatternHook(Glob([]byte("*#ACT*")), func(e Event) bool {
+			called = append(called, string(e.Key))
+			return string(e.Key) == "GAME2#ACT1"
+		})
+		assert.NoError(t, err)
+		_, err = db.AppendPatternHook(Glob([]byte("GAME*#SCORE")), func(e Event) bool {
+			called = append(called, string(e.Key))
+			return false
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("GAME1#ACT1"), []byte("KICK")))
+		assert.NoError(t, db.Put([]byte("GAME2#ACT1"), []byte("KICK")))
+		assert.NoError(t, db.Put([]byte("GAME3#ACT1"), []byte("KICK")))
+		assert.ErrorIs(t, db.RemoveHookByID(id), ErrKeyNotFound)
+		assert.NoError(t, db.RemoveHook([]byte("GAME")))
+		assert.NoError(t, db.Put([]byte("GAME1#SCORE"), []byte("10")))
+		assert.Equal(t, []string{"GAME1#ACT1", "GAME2#ACT1"}, called)
+
+		_, err = db.AppendPatternHook(Glob(nil), func(e Event) bool { return false })
+		assert.ErrorIs(t, err, ErrEmptyEntry)
+	})
+}
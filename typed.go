@@ -0,0 +1,225 @@
+package hookdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"iter"
+)
+
+// Codec converts values of T to and from bytes.
+// A codec for keys must preserve the order of keys, so that queries
+// iterate over them in the order of T.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(b []byte) (T, error)
+}
+
+// JSONCodec encodes values as JSON. It does not preserve order and is meant for values.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(b []byte) (v T, err error) {
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob. It does not preserve order and is meant for values.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(b []byte) (v T, err error) {
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+// StringCodec stores strings as is. It preserves order.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// RawCodec stores bytes as is. It preserves order.
+type RawCodec struct{}
+
+func (RawCodec) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (RawCodec) Decode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+// Int64Codec stores int64 in 8 bytes, big-endian with the sign bit flipped,
+// so that the bytes sort in numeric order including negative numbers.
+type Int64Codec struct{}
+
+func (Int64Codec) Encode(v int64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)^(1<<63)), nil
+}
+
+func (Int64Codec) Decode(b []byte) (int64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("int64 codec: invalid length %d", len(b))
+	}
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63)), nil
+}
+
+// Typed wraps a DB to put and get keys of K and values of V, converted by codecs.
+// It works on a HookDB and on a Transaction alike.
+type Typed[K, V any] struct {
+	db     *DB
+	keys   Codec[K]
+	values Codec[V]
+}
+
+func NewTyped[K, V any](db *DB, keys Codec[K], values Codec[V]) *Typed[K, V] {
+	return &Typed[K, V]{db: db, keys: keys, values: values}
+}
+
+func (t *Typed[K, V]) Get(k K) (v V, err error) {
+	kb, err := t.keys.Encode(k)
+	if err != nil {
+		return v, err
+	}
+	vb, err := t.db.Get(kb)
+	if err != nil {
+		return v, err
+	}
+	return t.values.Decode(vb)
+}
+
+func (t *Typed[K, V]) Put(k K, v V) error {
+	kb, err := t.keys.Encode(k)
+	if err != nil {
+		return err
+	}
+	vb, err := t.values.Encode(v)
+	if err != nil {
+		return err
+	}
+	return t.db.Put(kb, vb)
+}
+
+func (t *Typed[K, V]) Delete(k K) error {
+	kb, err := t.keys.Encode(k)
+	if err != nil {
+		return err
+	}
+	return t.db.Delete(kb)
+}
+
+// Query iterates over the keys whose encoding has the encoding of prefix as a prefix.
+func (t *Typed[K, V]) Query(ctx context.Context, prefix K, opts ...QueryOption) iter.Seq2[V, error] {
+	return func(yield func(V, error) bool) {
+		pb, err := t.keys.Encode(prefix)
+		if err != nil {
+			var zero V
+			yield(zero, err)
+			return
+		}
+		for vb, err := range t.db.Query(ctx, pb, opts...) {
+			if err != nil {
+				var zero V
+				if !yield(zero, err) {
+					return
+				}
+				continue
+			}
+			if !yield(t.values.Decode(vb)) {
+				return
+			}
+		}
+	}
+}
+
+// QueryRange iterates over the keys in [start, end).
+func (t *Typed[K, V]) QueryRange(ctx context.Context, start, end K, opts ...QueryOption) iter.Seq2[V, error] {
+	return func(yield func(V, error) bool) {
+		var zero V
+		sb, err := t.keys.Encode(start)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		eb, err := t.keys.Encode(end)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		for vb, err := range t.db.QueryRange(ctx, sb, eb, opts...) {
+			if err != nil {
+				if !yield(zero, err) {
+					return
+				}
+				continue
+			}
+			if !yield(t.values.Decode(vb)) {
+				return
+			}
+		}
+	}
+}
+
+// AppendHook registers fn to be called with every put of keys with the prefix.
+// Puts whose key or value cannot be decoded are not passed to fn.
+func (t *Typed[K, V]) AppendHook(prefix K, fn func(k K, v V) (removeHook bool)) (HookID, error) {
+	pb, err := t.keys.Encode(prefix)
+	if err != nil {
+		return HookID{}, err
+	}
+	return t.db.AppendHook(pb, func(kb, vb []byte) bool {
+		k, v, ok := t.decode(kb, vb)
+		if !ok {
+			return false
+		}
+		return fn(k, v)
+	})
+}
+
+// Subscribe is like DB.Subscribe but sends decoded values.
+// Puts whose key or value cannot be decoded are not sent.
+func (t *Typed[K, V]) Subscribe(ctx context.Context, prefix K, opts ...SubscribeOption) (<-chan V, error) {
+	pb, err := t.keys.Encode(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return subscribe(ctx, t.db, pb, opts, func(e Event) (V, bool) {
+		if e.Op != OpPut {
+			var zero V
+			return zero, false
+		}
+		_, v, ok := t.decode(e.Key, e.Value)
+		return v, ok
+	})
+}
+
+func (t *Typed[K, V]) decode(kb, vb []byte) (k K, v V, ok bool) {
+	k, err := t.keys.Decode(kb)
+	if err != nil {
+		return k, v, false
+	}
+	v, err = t.values.Decode(vb)
+	if err != nil {
+		return k, v, false
+	}
+	return k, v, true
+}
@@ -0,0 +1,113 @@
+package hookdb
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec(t *testing.T) {
+	ints := []int64{math.MinInt64, -1000, -1, 0, 1, 255, 256, math.MaxInt64}
+	var prev []byte
+	for _, n := range ints {
+		b, err := Int64Codec{}.Encode(n)
+		assert.NoError(t, err)
+		// encoded keys sort in numeric order
+		assert.Equal(t, -1, bytes.Compare(prev, b), n)
+		prev = b
+		got, err := Int64Codec{}.Decode(b)
+		assert.NoError(t, err)
+		assert.Equal(t, n, got)
+	}
+	_, err := Int64Codec{}.Decode([]byte("short"))
+	assert.Error(t, err)
+
+	type user struct {
+		Name string
+		Age  int
+	}
+	for _, c := range []Codec[user]{JSONCodec[user]{}, GobCodec[user]{}} {
+		b, err := c.Encode(user{Name: "alice", Age: 20})
+		assert.NoError(t, err)
+		got, err := c.Decode(b)
+		assert.NoError(t, err)
+		assert.Equal(t, user{Name: "alice", Age: 20}, got)
+	}
+}
+
+func TestTyped(t *testing.T) {
+	type order struct {
+		Item string `json:"item"`
+		Qty  int    `json:"qty"`
+	}
+
+	t.Run("string keys", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		orders := NewTyped(db.DB, StringCodec{}, JSONCodec[order]{})
+
+		var hooked []string
+		_, err := orders.AppendHook("order#", func(k string, v order) bool {
+			hooked = append(hooked, k+":"+v.Item)
+			return false
+		})
+		assert.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch, err := orders.Subscribe(ctx, "order#", WithBufSize(8))
+		assert.NoError(t, err)
+
+		assert.NoError(t, orders.Put("order#2", order{Item: "hat", Qty: 1}))
+		assert.NoError(t, orders.Put("order#1", order{Item: "shoes", Qty: 2}))
+		// not decodable as an order
+		assert.NoError(t, db.Put([]byte("order#3"), []byte("broken")))
+
+		got, err := orders.Get("order#1")
+		assert.NoError(t, err)
+		assert.Equal(t, order{Item: "shoes", Qty: 2}, got)
+		assert.Equal(t, []string{"order#2:hat", "order#1:shoes"}, hooked)
+		assert.Equal(t, "hat", (<-ch).Item)
+		assert.Equal(t, "shoes", (<-ch).Item)
+
+		var items []string
+		var errs int
+		for v, err := range orders.Query(context.Background(), "order#") {
+			if err != nil {
+				errs++
+				continue
+			}
+			items = append(items, v.Item)
+		}
+		assert.Equal(t, []string{"shoes", "hat"}, items)
+		assert.Equal(t, 1, errs)
+
+		assert.NoError(t, orders.Delete("order#1"))
+		_, err = orders.Get("order#1")
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("int keys", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		scores := NewTyped(db.DB, Int64Codec{}, StringCodec{})
+		for _, n := range []int64{10, -5, 300, 0, -200} {
+			assert.NoError(t, scores.Put(n, "score"))
+		}
+		txn := db.Transaction()
+		assert.NoError(t, NewTyped(txn.DB, Int64Codec{}, StringCodec{}).Put(20, "txn"))
+		assert.NoError(t, txn.Commit())
+
+		var got []string
+		for v, err := range scores.QueryRange(context.Background(), -100, 100) {
+			assert.NoError(t, err)
+			got = append(got, v)
+		}
+		assert.Equal(t, []string{"score", "score", "score", "txn"}, got)
+		v, err := scores.Get(20)
+		assert.NoError(t, err)
+		assert.Equal(t, "txn", v)
+	})
+}
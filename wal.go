@@ -0,0 +1,408 @@
+package hookdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const walFileName = "hookdb.wal"
+
+type (
+	// wal is an append-only log of mutations.
+	// Each record holds one batch of entries and is written with a single write call,
+	// so a batch is either replayed entirely or not at all.
+	//
+	//	record  := crc32(payload) uint32 | len(payload) uint32 | payload
+	//	payload := count uvarint | entry...
+	//	entry   := op byte | len(k) uvarint | k | len(v) uvarint | v
+	wal struct {
+		path string
+		f    *os.File
+		mu   sync.Mutex
+		size int64
+		// size of the log right after the last compaction
+		compacted int64
+
+		mode SyncMode
+		// dirty reports whether the log has writes not yet synced
+		dirty bool
+		// syncErr is the error of the last background sync
+		syncErr error
+		// compactErr is the error of the last failed compaction
+		compactErr error
+		stop       chan struct{}
+		done       chan struct{}
+		// closed reports whether the log is closed, guarded by mu
+		closed bool
+		// broken is the error of a failed append whose torn bytes could not be removed.
+		// Appends fail with it until compaction replaces the log.
+		broken error
+	}
+	walOp    byte
+	walEntry struct {
+		op walOp
+		k  []byte
+		v  []byte
+	}
+)
+
+const (
+	walPut walOp = iota + 1
+	walDelete
+	// walPutTTL is a put whose value is prefixed with the expiry deadline
+	// in unix nano as a big-endian uint64
+	walPutTTL
+	// walSeq holds the sequence number of the last write as a big-endian uint64
+	// at the end of a snapshot
+	walSeq
+)
+
+const walHeaderSize = 8
+
+// newPutEntry returns a put entry, or a walPutTTL entry if exp is not 0.
+func newPutEntry(k, v []byte, exp int64) walEntry {
+	if exp == 0 {
+		return walEntry{op: walPut, k: k, v: v}
+	}
+	ev := make([]byte, 8, 8+len(v))
+	binary.BigEndian.PutUint64(ev, uint64(exp))
+	return walEntry{op: walPutTTL, k: k, v: append(ev, v...)}
+}
+
+// ttlValue returns the value and the expiry deadline of a walPutTTL entry.
+func (e walEntry) ttlValue() ([]byte, int64, error) {
+	if len(e.v) < 8 {
+		return nil, 0, errCorruptRecord
+	}
+	return e.v[8:], int64(binary.BigEndian.Uint64(e.v[:8])), nil
+}
+
+func newSeqEntry(seq uint64) walEntry {
+	return walEntry{op: walSeq, v: binary.BigEndian.AppendUint64(nil, seq)}
+}
+
+// seqValue returns the sequence number of a walSeq entry.
+func (e walEntry) seqValue() (uint64, error) {
+	if len(e.v) != 8 {
+		return 0, errCorruptRecord
+	}
+	return binary.BigEndian.Uint64(e.v), nil
+}
+
+var errCorruptRecord = errors.New("corrupt wal record")
+
+// openWAL opens the log in dir, calls fn for every complete batch in it and
+// prepares the log for appending. A torn record at the tail, left by a crash
+// in the middle of a write, is truncated.
+func openWAL(dir string, fn func([]walEntry) error) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, walFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	size, err := readWAL(f, fn)
+	if err != nil && !errors.Is(err, errCorruptRecord) {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &wal{path: path, f: f, size: size, compacted: size}, nil
+}
+
+// readWAL reads records from r until EOF and returns the number of bytes of valid records.
+// It returns errCorruptRecord if r ends with an incomplete or broken record.
+func readWAL(r io.Reader, fn func([]walEntry) error) (int64, error) {
+	var (
+		br     = bufio.NewReader(r)
+		header = make([]byte, walHeaderSize)
+		size   int64
+	)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return size, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = errCorruptRecord
+			}
+			return size, err
+		}
+		sum := binary.BigEndian.Uint32(header[:4])
+		l := binary.BigEndian.Uint32(header[4:])
+		payload := make([]byte, l)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				err = errCorruptRecord
+			}
+			return size, err
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return size, errCorruptRecord
+		}
+		entries, err := decodeWALPayload(payload)
+		if err != nil {
+			return size, err
+		}
+		if err := fn(entries); err != nil {
+			return size, err
+		}
+		size += walHeaderSize + int64(l)
+	}
+}
+
+// setSyncMode sets when appended records are synced to stable storage.
+// With SyncPeriodic, the log is synced by a background goroutine every interval until close.
+func (w *wal) setSyncMode(mode SyncMode, interval time.Duration) {
+	w.mode = mode
+	if mode != SyncPeriodic {
+		return
+	}
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.mu.Lock()
+				if err := w.sync(); err != nil {
+					w.syncErr = err
+				}
+				w.mu.Unlock()
+			}
+		}
+	}()
+}
+
+func (w *wal) append(entries ...walEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	record := encodeWALRecord(entries)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if w.broken != nil {
+		return w.broken
+	}
+	n, err := w.f.Write(record)
+	if err != nil {
+		err = fmt.Errorf("wal: cannot append: %w", err)
+		// replay stops at a torn record, so records appended after it would be lost
+		if rerr := w.rewind(); rerr != nil {
+			w.broken = errors.Join(err, rerr)
+		}
+		return err
+	}
+	w.size += int64(n)
+	w.dirty = true
+	if w.mode == SyncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+// rewind removes the bytes written after the last complete record.
+func (w *wal) rewind() error {
+	if err := w.f.Truncate(w.size); err != nil {
+		return fmt.Errorf("wal: cannot remove torn record: %w", err)
+	}
+	if _, err := w.f.Seek(w.size, io.SeekStart); err != nil {
+		return fmt.Errorf("wal: cannot remove torn record: %w", err)
+	}
+	return nil
+}
+
+// Sync commits the log to stable storage and returns the error of
+// any failed background sync or compaction since the previous call.
+func (w *wal) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	err := errors.Join(w.syncErr, w.compactErr)
+	w.syncErr, w.compactErr = nil, nil
+	return errors.Join(err, w.sync())
+}
+
+func (w *wal) sync() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("wal: cannot sync: %w", err)
+	}
+	w.dirty = false
+	return nil
+}
+
+// needsCompaction reports whether the log exceeds threshold and has at least
+// doubled since the last compaction, so that a large live data set
+// does not cause a compaction on every write.
+func (w *wal) needsCompaction(threshold int64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.closed && threshold < w.size && 2*w.compacted <= w.size
+}
+
+// compact replaces the log with the records written by snapshot.
+// The new log is written to a temporary file and renamed over the old one,
+// so the old log stays intact if compaction fails. A failed compaction is not
+// retried until the log doubles again, and its error is kept for Sync.
+func (w *wal) compact(snapshot func(io.Writer) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	err := w.rewrite(snapshot)
+	if err != nil {
+		w.compacted = w.size
+		w.compactErr = err
+	}
+	return err
+}
+
+// rewrite writes the new log and replaces the old one with it. The caller must hold mu.
+func (w *wal) rewrite(snapshot func(io.Writer) error) error {
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("wal: cannot compact: %w", err)
+	}
+	err = snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, w.path)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("wal: cannot compact: %w", err)
+	}
+	_ = syncDir(filepath.Dir(w.path))
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = f.Close()
+		// the old log is replaced, so appends to it would be lost
+		w.broken = fmt.Errorf("wal: cannot compact: %w", err)
+		return w.broken
+	}
+	_ = w.f.Close()
+	w.f = f
+	w.size = size
+	w.compacted = size
+	w.dirty = false
+	w.broken = nil
+	return nil
+}
+
+// close syncs and closes the log. Closing a closed log does nothing.
+func (w *wal) close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := errors.Join(w.syncErr, w.compactErr, w.sync())
+	return errors.Join(err, w.f.Close())
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func encodeWALRecord(entries []walEntry) []byte {
+	l := binary.MaxVarintLen64
+	for _, e := range entries {
+		l += 1 + 2*binary.MaxVarintLen64 + len(e.k) + len(e.v)
+	}
+	buf := make([]byte, walHeaderSize, walHeaderSize+l)
+	buf = binary.AppendUvarint(buf, uint64(len(entries)))
+	for _, e := range entries {
+		buf = append(buf, byte(e.op))
+		buf = binary.AppendUvarint(buf, uint64(len(e.k)))
+		buf = append(buf, e.k...)
+		buf = binary.AppendUvarint(buf, uint64(len(e.v)))
+		buf = append(buf, e.v...)
+	}
+	payload := buf[walHeaderSize:]
+	binary.BigEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(buf[4:walHeaderSize], uint32(len(payload)))
+	return buf
+}
+
+func decodeWALPayload(payload []byte) ([]walEntry, error) {
+	n, l := binary.Uvarint(payload)
+	if l <= 0 {
+		return nil, errCorruptRecord
+	}
+	payload = payload[l:]
+	entries := make([]walEntry, 0, min(n, uint64(len(payload))))
+	readBytes := func() ([]byte, bool) {
+		size, l := binary.Uvarint(payload)
+		if l <= 0 || uint64(len(payload)-l) < size {
+			return nil, false
+		}
+		b := payload[l : l+int(size) : l+int(size)]
+		payload = payload[l+int(size):]
+		return b, true
+	}
+	for range n {
+		if len(payload) == 0 {
+			return nil, errCorruptRecord
+		}
+		e := walEntry{op: walOp(payload[0])}
+		payload = payload[1:]
+		var ok bool
+		if e.k, ok = readBytes(); !ok {
+			return nil, errCorruptRecord
+		}
+		if e.v, ok = readBytes(); !ok {
+			return nil, errCorruptRecord
+		}
+		entries = append(entries, e)
+	}
+	if len(payload) != 0 {
+		return nil, errCorruptRecord
+	}
+	return entries, nil
+}
@@ -0,0 +1,326 @@
+package hookdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL(t *testing.T) {
+	t.Run("replay", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir)
+		require.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		assert.NoError(t, db.Put([]byte("key-2"), []byte("val-2")))
+		assert.NoError(t, db.Put([]byte("key-2"), []byte("newval-2")))
+		assert.NoError(t, db.Put([]byte("key-3"), []byte("val-3")))
+		assert.NoError(t, db.Delete([]byte("key-3")))
+		assert.ErrorIs(t, db.Delete([]byte("key-4")), ErrKeyNotFound)
+
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("key-4"), []byte("val-4")))
+		assert.NoError(t, txn.Delete([]byte("key-1")))
+		assert.NoError(t, txn.Commit())
+
+		// rollbacked transaction is not logged
+		txn = db.Transaction()
+		assert.NoError(t, txn.Put([]byte("key-5"), []byte("val-5")))
+		assert.NoError(t, txn.Rollback())
+		require.NoError(t, db.Close())
+
+		db, err = Open(dir)
+		require.NoError(t, err)
+		defer db.Close()
+
+		_, err = db.Get([]byte("key-1"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		v, err := db.Get([]byte("key-2"))
+		assert.NoError(t, err)
+		assert.Equal(t, "newval-2", string(v))
+		_, err = db.Get([]byte("key-3"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		v, err = db.Get([]byte("key-4"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-4", string(v))
+		_, err = db.Get([]byte("key-5"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("torn record", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir)
+		require.NoError(t, err)
+
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("key-2"), []byte("val-2")))
+		assert.NoError(t, txn.Put([]byte("key-3"), []byte("val-3")))
+		assert.NoError(t, txn.Commit())
+		require.NoError(t, db.Close())
+
+		// crash in the middle of writing the transaction
+		path := filepath.Join(dir, walFileName)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(path, info.Size()-3))
+
+		db, err = Open(dir)
+		require.NoError(t, err)
+
+		v, err := db.Get([]byte("key-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-1", string(v))
+		_, err = db.Get([]byte("key-2"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		_, err = db.Get([]byte("key-3"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+
+		// torn tail is truncated and the log is appendable
+		assert.NoError(t, db.Put([]byte("key-2"), []byte("val-2")))
+		require.NoError(t, db.Close())
+		db, err = Open(dir)
+		require.NoError(t, err)
+		defer db.Close()
+		v, err = db.Get([]byte("key-2"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-2", string(v))
+	})
+
+	t.Run("torn append", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir)
+		require.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+
+		// a short write leaves a torn record, which is removed before the next append
+		w := db.l3.(*l3Store).wal
+		record := encodeWALRecord([]walEntry{{op: walPut, k: []byte("key-2"), v: []byte("val-2")}})
+		_, err = w.f.Write(record[:len(record)-3])
+		require.NoError(t, err)
+		require.NoError(t, w.rewind())
+		assert.NoError(t, db.Put([]byte("key-3"), []byte("val-3")))
+		require.NoError(t, db.Close())
+
+		db, err = Open(dir)
+		require.NoError(t, err)
+		defer db.Close()
+		for _, k := range []string{"key-1", "key-3"} {
+			_, err := db.Get([]byte(k))
+			assert.NoError(t, err, k)
+		}
+		_, err = db.Get([]byte("key-2"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("failed commit", func(t *testing.T) {
+		t.Parallel()
+		db, err := Open(t.TempDir())
+		require.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+
+		// the log cannot be written
+		require.NoError(t, db.l3.(*l3Store).wal.f.Close())
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("key-1"), []byte("newval-1")))
+		assert.NoError(t, txn.Put([]byte("key-2"), []byte("val-2")))
+		err = txn.Commit()
+		assert.Error(t, err)
+		assert.NotContains(t, err.Error(), "%!w")
+
+		v, err := db.Get([]byte("key-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "val-1", string(v))
+		_, err = db.Get([]byte("key-2"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		// the log cannot be rewound, so it rejects appends
+		assert.Error(t, db.l3.(*l3Store).wal.broken)
+	})
+
+	t.Run("hook error after commit", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		var herrs []*HookError
+		db, err := Open(dir, WithMaxHookDepth(0), WithOnHookError(func(err *HookError) {
+			herrs = append(herrs, err)
+		}))
+		require.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+		_, err = db.AppendContextHook([]byte("key"), func(hc *HookContext, e Event) bool {
+			hc.Put([]byte("derived"), e.Value)
+			return false
+		})
+		require.NoError(t, err)
+
+		txn := db.Transaction()
+		assert.NoError(t, txn.Put([]byte("key-1"), []byte("newval-1")))
+		assert.NoError(t, txn.Put([]byte("key-2"), []byte("val-2")))
+		assert.NoError(t, txn.Commit())
+		require.Len(t, herrs, 2)
+		assert.ErrorIs(t, herrs[0], ErrHookDepthExceeded)
+		assert.Equal(t, "key-1", string(herrs[0].Key))
+		assert.Equal(t, "key-2", string(herrs[1].Key))
+
+		check := func(db *HookDB) {
+			v, err := db.Get([]byte("key-1"))
+			assert.NoError(t, err)
+			assert.Equal(t, "newval-1", string(v))
+			v, err = db.Get([]byte("key-2"))
+			assert.NoError(t, err)
+			assert.Equal(t, "val-2", string(v))
+		}
+		check(db)
+		require.NoError(t, db.Close())
+		db, err = Open(dir)
+		require.NoError(t, err)
+		defer db.Close()
+		check(db)
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Run("restore", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		for _, k := range []string{"user03", "user01", "item01", "user02"} {
+			assert.NoError(t, db.Put([]byte(k), []byte("old-"+k)))
+			assert.NoError(t, db.Put([]byte(k), []byte(k)))
+		}
+		assert.NoError(t, db.Delete([]byte("item01")))
+
+		var buf bytes.Buffer
+		require.NoError(t, db.Snapshot(&buf))
+
+		restored, err := Restore(&buf)
+		require.NoError(t, err)
+		var got []string
+		for v, err := range restored.Query(context.Background(), []byte("user")) {
+			assert.NoError(t, err)
+			got = append(got, string(v))
+		}
+		assert.Equal(t, []string{"user01", "user02", "user03"}, got)
+		_, err = restored.Get([]byte("item01"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		t.Parallel()
+		db := New()
+		assert.NoError(t, db.Put([]byte("key"), []byte("val")))
+		var buf bytes.Buffer
+		require.NoError(t, db.Snapshot(&buf))
+		buf.Truncate(buf.Len() - 1)
+		_, err := Restore(&buf)
+		assert.ErrorIs(t, err, errCorruptRecord)
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir, WithCompactionSize(1024))
+		require.NoError(t, err)
+
+		for i := range 1000 {
+			err := db.Put([]byte("counter"), []byte(fmt.Sprint(i)))
+			assert.NoError(t, err)
+		}
+		info, err := os.Stat(filepath.Join(dir, walFileName))
+		require.NoError(t, err)
+		assert.Less(t, info.Size(), int64(2048))
+		require.NoError(t, db.Close())
+
+		db, err = Open(dir)
+		require.NoError(t, err)
+		defer db.Close()
+		v, err := db.Get([]byte("counter"))
+		assert.NoError(t, err)
+		assert.Equal(t, "999", string(v))
+	})
+
+	t.Run("failed compaction", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		db, err := Open(dir, WithCompactionSize(1024))
+		require.NoError(t, err)
+		defer db.Close()
+
+		// the temporary file cannot be created
+		tmp := filepath.Join(dir, walFileName+".tmp")
+		require.NoError(t, os.Mkdir(tmp, 0o755))
+		w := db.l3.(*l3Store).wal
+		for i := 0; w.compactErr == nil; i++ {
+			assert.NoError(t, db.Put([]byte("counter"), []byte(fmt.Sprint(i))))
+		}
+		// compaction is not retried until the log doubles
+		size := w.size
+		assert.NoError(t, db.Put([]byte("counter"), []byte("0")))
+		assert.False(t, w.needsCompaction(1024))
+		assert.ErrorContains(t, db.Sync(), "cannot compact")
+		assert.NoError(t, db.Sync())
+
+		require.NoError(t, os.Remove(tmp))
+		for n := 0; size <= w.size; n++ {
+			require.Less(t, n, 1000)
+			assert.NoError(t, db.Put([]byte("counter"), []byte("0")))
+		}
+		assert.NoError(t, db.Sync())
+	})
+}
+
+func TestSyncMode(t *testing.T) {
+	test := []struct {
+		name string
+		opts []Option
+	}{
+		{"none", []Option{WithSyncMode(SyncNone)}},
+		{"always", []Option{WithSyncMode(SyncAlways)}},
+		{"periodic", []Option{WithSyncMode(SyncPeriodic), WithSyncInterval(time.Millisecond)}},
+	}
+	for _, tt := range test {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			db, err := Open(dir, tt.opts...)
+			require.NoError(t, err)
+
+			assert.NoError(t, db.Put([]byte("key-1"), []byte("val-1")))
+			txn := db.Transaction()
+			assert.NoError(t, txn.Put([]byte("key-2"), []byte("val-2")))
+			assert.NoError(t, txn.Commit())
+			time.Sleep(5 * time.Millisecond)
+			assert.NoError(t, db.Sync())
+			require.NoError(t, db.Close())
+
+			// closed
+			assert.NoError(t, db.Close())
+			assert.ErrorIs(t, db.Put([]byte("key-3"), []byte("val-3")), ErrClosed)
+			assert.ErrorIs(t, db.Delete([]byte("key-1")), ErrClosed)
+			txn = db.Transaction()
+			assert.NoError(t, txn.Put([]byte("key-3"), []byte("val-3")))
+			assert.ErrorIs(t, txn.Commit(), ErrClosed)
+			assert.ErrorIs(t, db.Sync(), ErrClosed)
+
+			db, err = Open(dir)
+			require.NoError(t, err)
+			defer db.Close()
+			v, err := db.Get([]byte("key-2"))
+			assert.NoError(t, err)
+			assert.Equal(t, "val-2", string(v))
+		})
+	}
+
+	_, err := Open(t.TempDir(), WithSyncInterval(0))
+	assert.Error(t, err)
+	assert.NoError(t, New().Sync())
+}